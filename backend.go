@@ -2,10 +2,13 @@ package proxmox
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"strings"
 	"sync"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -19,12 +22,22 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 
 type proxmoxBackend struct {
 	*framework.Backend
-	lock   sync.RWMutex
-	client *proxmoxClient
+	lock    sync.RWMutex
+	clients map[string]proxmoxClient
+
+	// newClient builds the client of a connection from its configuration
+	newClient func(config *proxmoxConfig) (proxmoxClient, error)
+
+	staticRoleLock sync.RWMutex
+	rotateRootLock sync.Mutex
+	tidyLock       sync.Mutex
 }
 
 func backend() *proxmoxBackend {
-	var b = proxmoxBackend{}
+	var b = proxmoxBackend{
+		clients:   make(map[string]proxmoxClient),
+		newClient: newClient,
+	}
 
 	b.Backend = &framework.Backend{
 		Help: strings.TrimSpace(backendHelp),
@@ -32,68 +45,130 @@ func backend() *proxmoxBackend {
 			LocalStorage: []string{},
 			SealWrapStorage: []string{
 				"config",
+				"config/*",
 				"role/*",
+				"static-role/*",
 			},
 		},
 		Paths: framework.PathAppend(
 			pathRole(&b),
+			pathStaticRole(&b),
+			pathTokens(&b),
 			[]*framework.Path{
+				pathConfigList(&b),
+				pathConfigRotateRoot(&b),
+				pathConfigFingerprint(&b),
+				pathConfigAutoTidy(&b),
 				pathConfig(&b),
 				pathCredentials(&b),
+				pathStaticCredentials(&b),
+				pathTidy(&b),
 			},
 		),
 		Secrets: []*framework.Secret{
 			b.proxmoxToken(),
+			b.proxmoxTicket(),
 		},
-		BackendType: logical.TypeLogical,
-		Invalidate:  b.invalidate,
+		BackendType:  logical.TypeLogical,
+		Invalidate:   b.invalidate,
+		Clean:        b.clean,
+		PeriodicFunc: b.periodicFunc,
+
+		WALRollback:       b.walRollback,
+		WALRollbackMinAge: walRollbackMinAge,
 	}
 	return &b
 }
 
-func (b *proxmoxBackend) reset() {
+// reset drops the cached client of a connection so the next request builds it from the stored configuration
+func (b *proxmoxBackend) reset(connection string) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	b.client = nil
+
+	if client, ok := b.clients[connection]; ok {
+		client.CloseIdleConnections()
+		delete(b.clients, connection)
+	}
+}
+
+// clean drops the cached clients of all connections when the backend is unmounted
+func (b *proxmoxBackend) clean(ctx context.Context) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for connection, client := range b.clients {
+		client.CloseIdleConnections()
+		delete(b.clients, connection)
+	}
 }
 
 func (b *proxmoxBackend) invalidate(ctx context.Context, key string) {
-	if key == "config" {
-		b.reset()
+	switch {
+	case key == configStoragePath:
+		b.reset(defaultConnectionName)
+	case strings.HasPrefix(key, configStoragePath+"/"):
+		b.reset(strings.TrimPrefix(key, configStoragePath+"/"))
 	}
 }
 
-func (b *proxmoxBackend) getClient(ctx context.Context, s logical.Storage) (*proxmoxClient, error) {
+func (b *proxmoxBackend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	// only the active node may write to storage
+	if b.System().ReplicationState().HasState(consts.ReplicationPerformanceStandby | consts.ReplicationPerformanceSecondary) {
+		return nil
+	}
+
+	return errors.Join(
+		b.rotateRootIfDue(ctx, req.Storage),
+		b.rotateDueStaticRoles(ctx, req.Storage),
+		b.tidyIfDue(ctx, req.Storage),
+	)
+}
+
+func (b *proxmoxBackend) getClient(ctx context.Context, s logical.Storage, connection string) (proxmoxClient, error) {
+	if connection == "" {
+		connection = defaultConnectionName
+	}
+
 	b.lock.RLock()
 	unlockFunc := b.lock.RUnlock
 	defer func() { unlockFunc() }()
 
-	if b.client != nil {
-		return b.client, nil
+	if client, ok := b.clients[connection]; ok {
+		return client, nil
 	}
 
 	b.lock.RUnlock()
 	b.lock.Lock()
 	unlockFunc = b.lock.Unlock
 
-	config, err := getConfig(ctx, s)
+	if client, ok := b.clients[connection]; ok {
+		return client, nil
+	}
+
+	config, err := getConfig(ctx, s, connection)
 	if err != nil {
 		return nil, err
 	}
 
 	if config == nil {
+		if connection != defaultConnectionName {
+			return nil, fmt.Errorf("connection %q is not configured", connection)
+		}
 		config = new(proxmoxConfig)
 	}
 
-	b.client, err = newClient(config)
+	client, err := b.newClient(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return b.client, nil
+	b.clients[connection] = client
+
+	return client, nil
 }
 
 const backendHelp = `
 The Proxmox secrets backend dynamically generates API tokens for connecting to a Proxmox API endpoint.
-After mounting this backend, credentials to manage Proxmox API tokens must be configured with the "config/" endpoints.
+After mounting this backend, credentials to manage Proxmox API tokens must be configured with the "config/" endpoints,
+one mount can manage several clusters through named connections.
 `
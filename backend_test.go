@@ -7,7 +7,6 @@ import (
 	"testing"
 	"time"
 
-	pxapi "github.com/Telmate/proxmox-api-go/proxmox"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/helper/logging"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -239,16 +238,11 @@ func (e *testEnv) CleanupApiTokens(t *testing.T) {
 
 	for _, token := range e.Tokens {
 		b := e.Backend.(*proxmoxBackend)
-		c, err := b.getClient(e.Context, e.Storage)
+		c, err := b.getClient(e.Context, e.Storage, defaultConnectionName)
 		if err != nil {
 			t.Fatal("fatal getting client")
 		}
 
-		u, err := pxapi.NewConfigUserFromApi(pxapi.UserID{Name: e.RoleUser, Realm: e.RoleRealm}, c.Client)
-		if err != nil {
-			t.Fatalf("unexpected error creating ConfigUser to delete token: %s", err)
-		}
-
-		u.DeleteApiToken(c.Client, pxapi.ApiToken{TokenId: token})
+		c.DeleteToken(e.Context, e.RoleUser, e.RoleRealm, token)
 	}
 }
@@ -1,18 +1,139 @@
 package proxmox
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-
-	pxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type proxmoxClient struct {
-	*pxapi.Client
+const defaultTLSMinVersion = "tls12"
+
+var tlsVersions = map[string]uint16{
+	"tls10": tls.VersionTLS10,
+	"tls11": tls.VersionTLS11,
+	"tls12": tls.VersionTLS12,
+	"tls13": tls.VersionTLS13,
+}
+
+// proxmoxClient is everything the engine does on Proxmox. Apart from the implementations nothing talks to the
+// API directly, so a different client, a fake or a recording client can be used without touching the paths.
+type proxmoxClient interface {
+	// Version returns the version of Proxmox VE
+	Version(ctx context.Context) (string, error)
+	// Permissions returns the privileges the client's own token has on a path
+	Permissions(ctx context.Context, path string) (map[string]bool, error)
+
+	RealmExists(ctx context.Context, realm string) (bool, error)
+
+	// GetUser returns a user, or nil if it doesn't exist
+	GetUser(ctx context.Context, user string, realm string) (*proxmoxUserInfo, error)
+	UserExists(ctx context.Context, user string, realm string) (bool, error)
+	CreateUser(ctx context.Context, user string, realm string, password string, groups []string, expire int64) error
+	DeleteUser(ctx context.Context, user string, realm string) error
+	SetUserExpire(ctx context.Context, user string, realm string, expire int64) error
+	SetUserPassword(ctx context.Context, user string, realm string, password string) error
+	CreateTicket(ctx context.Context, user string, realm string, password string) (*proxmoxTicket, error)
+
+	// CreateToken creates a token and returns it with its secret, or an error wrapping errTokenExists if
+	// the user already has a token with that ID
+	CreateToken(ctx context.Context, user string, realm string, tokenID string, comment string, expire int64, privsep bool) (*proxmoxToken, error)
+	GetToken(ctx context.Context, user string, realm string, tokenID string) (*proxmoxTokenInfo, error)
+	ListTokens(ctx context.Context, user string, realm string) ([]*proxmoxTokenInfo, error)
+	SetTokenExpire(ctx context.Context, user string, realm string, tokenID string, expire int64) error
+	DeleteToken(ctx context.Context, user string, realm string, tokenID string) error
+
+	SetTokenACLs(ctx context.Context, user string, realm string, tokenID string, acls []proxmoxACLEntry) error
+	// GetTokenACLs returns the ACL entries granted directly to a token
+	GetTokenACLs(ctx context.Context, user string, realm string, tokenID string) ([]proxmoxACLEntry, error)
+
+	CreateRole(ctx context.Context, roleID string, privileges []string) error
+	DeleteRole(ctx context.Context, roleID string) error
+	RoleExists(ctx context.Context, roleID string) (bool, error)
+
+	// CloseIdleConnections closes the kept-alive connections of a client that is no longer used
+	CloseIdleConnections()
+}
+
+// httpClient implements proxmoxClient with plain requests against the Proxmox API. Requests follow the
+// deadline and cancellation of their context, and all of them share the connections of one transport.
+type httpClient struct {
+	apiURL  string
+	auth    string
+	headers http.Header
+	client  *http.Client
+
+	maxAttempts int
+	retryDelay  time.Duration
+}
+
+var _ proxmoxClient = (*httpClient)(nil)
+
+// errNotFound matches API errors about a token, user or role that doesn't exist
+var errNotFound = errors.New("not found in Proxmox")
+
+// notFoundErrors are messages Proxmox answers with when a token, user or role doesn't exist, with a 500
+var notFoundErrors = []string{
+	"no such token",
+	"no such user",
+	"does not exist",
+}
+
+// apiError is an error returned by the Proxmox API, which reports the reason in the status line and
+// problems with single parameters in the body
+type apiError struct {
+	StatusCode int
+	Message    string
+	Errors     map[string]string
 }
 
-func newClient(config *proxmoxConfig) (*proxmoxClient, error) {
+func (e *apiError) Error() string {
+	msg := fmt.Sprintf("%d %s", e.StatusCode, e.Message)
+
+	if len(e.Errors) > 0 {
+		params := make([]string, 0, len(e.Errors))
+		for param := range e.Errors {
+			params = append(params, param)
+		}
+		sort.Strings(params)
+
+		details := make([]string, 0, len(params))
+		for _, param := range params {
+			details = append(details, fmt.Sprintf("%s: %s", param, strings.TrimSpace(e.Errors[param])))
+		}
+		msg += " (" + strings.Join(details, ", ") + ")"
+	}
+
+	return msg
+}
+
+// Is makes errors.Is(err, errNotFound) match responses about a missing token, user or role
+func (e *apiError) Is(target error) bool {
+	if target != errNotFound {
+		return false
+	}
+
+	for _, notFound := range notFoundErrors {
+		if strings.Contains(e.Message, notFound) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newClient(config *proxmoxConfig) (proxmoxClient, error) {
 	if config == nil {
 		return nil, errors.New("client configuration was nil")
 	}
@@ -23,19 +144,332 @@ func newClient(config *proxmoxConfig) (*proxmoxClient, error) {
 
 	fullToken := fmt.Sprintf("%s@%s!%s", config.User, config.Realm, config.ApiTokenID)
 
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := parseHTTPHeaders(config.HTTPHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := newTransport(config, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpClient{
+		apiURL:  strings.TrimSuffix(config.ApiURL, "/"),
+		auth:    "PVEAPIToken=" + fullToken + "=" + config.ApiTokenSecret,
+		headers: headers,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   config.TaskTimeout,
+		},
+		maxAttempts: config.maxAttempts(),
+		retryDelay:  defaultRetryDelay,
+	}, nil
+}
+
+// newTransport returns the transport a connection reaches the Proxmox API through
+func newTransport(config *proxmoxConfig, tlsConfig *tls.Config) (*http.Transport, error) {
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	if config.ProxyServer != "" {
+		proxyURL, err := neturl.ParseRequestURI(config.ProxyServer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy_server: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return transport, nil
+}
+
+func (c *httpClient) CloseIdleConnections() {
+	c.client.CloseIdleConnections()
+}
+
+// parseHTTPHeaders parses http_headers, a comma separated list of alternating header names and values
+func parseHTTPHeaders(raw string) (http.Header, error) {
+	headers := make(http.Header)
+	if raw == "" {
+		return headers, nil
+	}
+
+	parts := strings.Split(raw, ",")
+	if len(parts)%2 != 0 {
+		return nil, errors.New("invalid http_headers, expected alternating header names and values")
+	}
+
+	for i := 0; i < len(parts); i += 2 {
+		headers.Set(parts[i], parts[i+1])
+	}
+
+	return headers, nil
+}
+
+func (c *httpClient) get(ctx context.Context, path string, params neturl.Values, result interface{}) error {
+	return c.do(ctx, http.MethodGet, path, params, result)
+}
+
+func (c *httpClient) post(ctx context.Context, path string, params neturl.Values, result interface{}) error {
+	return c.do(ctx, http.MethodPost, path, params, result)
+}
+
+func (c *httpClient) put(ctx context.Context, path string, params neturl.Values) error {
+	return c.do(ctx, http.MethodPut, path, params, nil)
+}
+
+func (c *httpClient) delete(ctx context.Context, path string) error {
+	return c.do(ctx, http.MethodDelete, path, nil, nil)
+}
+
+// do makes a request, retrying it as long as it fails with a transient error that's safe to retry
+func (c *httpClient) do(ctx context.Context, method string, path string, params neturl.Values, result interface{}) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = c.roundTrip(ctx, method, path, params, result)
+		if err == nil || attempt >= c.maxAttempts || !retryable(method, err) {
+			return err
+		}
+
+		timer := time.NewTimer(retryBackoff(c.retryDelay, attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// roundTrip makes a single request, sending params in the query or as a form, and decodes the "data"
+// the API wraps every response in into result
+func (c *httpClient) roundTrip(ctx context.Context, method string, path string, params neturl.Values, result interface{}) error {
+	reqURL := c.apiURL + path
+
+	var body io.Reader
+	if method == http.MethodPost || method == http.MethodPut {
+		body = strings.NewReader(params.Encode())
+	} else if len(params) > 0 {
+		reqURL += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+	if err != nil {
+		return err
+	}
+
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", c.auth)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Data   json.RawMessage   `json:"data"`
+		Errors map[string]string `json:"errors"`
+	}
+
+	// error responses usually have a body too, but it's not worth failing over if it can't be read
+	decodeErr := json.NewDecoder(resp.Body).Decode(&envelope)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &apiError{
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+			Errors:     envelope.Errors,
+		}
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	if decodeErr != nil {
+		return fmt.Errorf("error decoding response: %w", decodeErr)
+	}
+
+	if len(envelope.Data) == 0 || string(envelope.Data) == "null" {
+		return errors.New("no data in response")
+	}
+
+	if err := json.Unmarshal(envelope.Data, result); err != nil {
+		return fmt.Errorf("error decoding response: %w", err)
+	}
+
+	return nil
+}
+
+// boolParam formats a boolean the way the API expects it
+func boolParam(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// userPath returns the API path of a user, with any sub paths appended
+func userPath(user string, realm string, subPaths ...string) string {
+	path := "/access/users/" + neturl.PathEscape(formatUserID(user, realm))
+	for _, subPath := range subPaths {
+		path += "/" + neturl.PathEscape(subPath)
+	}
+	return path
+}
+
+// newTLSConfig builds the TLS configuration used to talk to the Proxmox API
+func newTLSConfig(config *proxmoxConfig) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[config.tlsMinVersion()]
+	if !ok {
+		return nil, fmt.Errorf("invalid tls_min_version %q, must be one of tls10, tls11, tls12 or tls13", config.TLSMinVersion)
+	}
+
 	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
+		InsecureSkipVerify: config.SkipCertValidation,
+		ServerName:         config.TLSServerName,
+		MinVersion:         minVersion,
 	}
-	if !config.SkipCertValidation {
-		tlsConfig = nil
+
+	if len(config.TLSFingerprints) > 0 {
+		fingerprints := make(map[string]bool, len(config.TLSFingerprints))
+		for _, fingerprint := range config.TLSFingerprints {
+			normalized, err := normalizeFingerprint(fingerprint)
+			if err != nil {
+				return nil, err
+			}
+			fingerprints[normalized] = true
+		}
+
+		// a pinned certificate is trusted on its own, Proxmox nodes usually have self-signed ones that
+		// wouldn't pass the regular chain verification
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no certificate presented by the Proxmox API")
+			}
+
+			fingerprint := certificateFingerprint(rawCerts[0])
+			if !fingerprints[fingerprint] {
+				return fmt.Errorf("certificate fingerprint %s of the Proxmox API is not in tls_fingerprints", fingerprint)
+			}
+
+			return nil
+		}
 	}
 
-	c, err := pxapi.NewClient(config.ApiURL, nil, config.HTTPHeaders, tlsConfig, config.ProxyServer, int(config.TaskTimeout.Seconds()))
+	if config.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(config.CACert)) {
+			return nil, errors.New("ca_cert does not contain any valid PEM encoded certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (config.ClientCert == "") != (config.ClientKey == "") {
+		return nil, errors.New("client_cert and client_key must be set together")
+	}
+
+	if config.ClientCert != "" {
+		cert, err := tls.X509KeyPair([]byte(config.ClientCert), []byte(config.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client_cert or client_key: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// certificateFingerprint returns the SHA-256 fingerprint of a DER encoded certificate in the form Proxmox shows it
+func certificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":")
+}
+
+// normalizeFingerprint accepts a SHA-256 fingerprint with or without colons in any case and returns it
+// in the form Proxmox shows it
+func normalizeFingerprint(fingerprint string) (string, error) {
+	raw, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+	if err != nil || len(raw) != sha256.Size {
+		return "", fmt.Errorf("invalid tls_fingerprints entry %q, must be a SHA-256 fingerprint", fingerprint)
+	}
+
+	parts := make([]string, len(raw))
+	for i, b := range raw {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":"), nil
+}
+
+// fetchCertificate connects to the Proxmox API of a connection the way its client does, through the same
+// proxy and with the same server name, and returns the certificate it presents without verifying it
+func fetchCertificate(ctx context.Context, config *proxmoxConfig, timeout time.Duration) (*x509.Certificate, error) {
+	u, err := neturl.Parse(config.ApiURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxmox_url: %w", err)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxmox_url %q, missing host", config.ApiURL)
+	}
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the whole point is to look at a certificate that isn't trusted yet
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyPeerCertificate = nil
+
+	transport, err := newTransport(config, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
+	defer transport.CloseIdleConnections()
 
-	c.SetAPIToken(fullToken, config.ApiTokenSecret)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// any response will do, the certificate is known once the connection is established
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to Proxmox API: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return nil, errors.New("no certificate presented by the Proxmox API")
+	}
 
-	return &proxmoxClient{c}, nil
+	return resp.TLS.PeerCertificates[0], nil
 }
@@ -0,0 +1,238 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testFakeClient returns a client for a fake Proxmox, authenticated with the token the fake is seeded with
+func testFakeClient(t *testing.T, fake *fakeProxmox) proxmoxClient {
+	t.Helper()
+
+	client, err := newClient(&proxmoxConfig{
+		User:            user,
+		Realm:           realm,
+		ApiTokenID:      token_id,
+		ApiTokenSecret:  token_secret,
+		ApiURL:          fake.apiURL(),
+		TLSFingerprints: []string{fake.fingerprint()},
+		TaskTimeout:     timeout * time.Second,
+	})
+	require.NoError(t, err)
+
+	// keep retries quick
+	client.(*httpClient).retryDelay = time.Millisecond
+
+	return client
+}
+
+func TestClient(t *testing.T) {
+	t.Run("Single Round Trip Per Token Operation", func(t *testing.T) {
+		_, _, fake := getTestBackend(t)
+		fake.addUser(formatUserID(testUser, testRealm))
+		client := testFakeClient(t, fake)
+
+		userPath := "/access/users/" + formatUserID(testUser, testRealm)
+
+		token, err := client.CreateToken(context.Background(), testUser, testRealm, "round-trip", vaultComment, 0, false)
+		require.NoError(t, err)
+		require.NotEmpty(t, token.Secret)
+
+		err = client.SetTokenExpire(context.Background(), testUser, testRealm, "round-trip", time.Now().Add(time.Hour).Unix())
+		require.NoError(t, err)
+
+		err = client.DeleteToken(context.Background(), testUser, testRealm, "round-trip")
+		require.NoError(t, err)
+
+		require.Equal(t, []string{
+			http.MethodPost + " " + userPath + "/token/round-trip",
+			http.MethodPut + " " + userPath + "/token/round-trip",
+			http.MethodDelete + " " + userPath + "/token/round-trip",
+		}, fake.requestLog())
+	})
+
+	t.Run("Token Exists", func(t *testing.T) {
+		_, _, fake := getTestBackend(t)
+		fake.addUser(formatUserID(testUser, testRealm))
+		fake.addToken(formatUserID(testUser, testRealm), "taken")
+		client := testFakeClient(t, fake)
+
+		_, err := client.CreateToken(context.Background(), testUser, testRealm, "taken", vaultComment, 0, false)
+		require.ErrorIs(t, err, errTokenExists)
+
+		var apiErr *apiError
+		require.True(t, errors.As(err, &apiErr))
+		require.Equal(t, http.StatusInternalServerError, apiErr.StatusCode)
+	})
+
+	t.Run("Not Found", func(t *testing.T) {
+		_, _, fake := getTestBackend(t)
+		fake.addUser(formatUserID(testUser, testRealm))
+		client := testFakeClient(t, fake)
+
+		err := client.DeleteToken(context.Background(), testUser, testRealm, "missing")
+		require.ErrorIs(t, err, errNotFound)
+
+		err = client.DeleteUser(context.Background(), "missing", testRealm)
+		require.ErrorIs(t, err, errNotFound)
+
+		err = client.CreateRole(context.Background(), privilegeRoleID("missing"), []string{"VM.Audit"})
+		require.NoError(t, err)
+
+		err = client.CreateRole(context.Background(), privilegeRoleID("missing"), []string{"VM.Audit"})
+		require.Error(t, err)
+		require.NotErrorIs(t, err, errNotFound)
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		_, _, fake := getTestBackend(t)
+		client := testFakeClient(t, fake)
+
+		fake.inject(fakeFault{Method: http.MethodGet, Path: "/version", Delay: 2 * time.Second})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := client.Version(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("Cancellation", func(t *testing.T) {
+		_, _, fake := getTestBackend(t)
+		client := testFakeClient(t, fake)
+
+		fake.inject(fakeFault{Method: http.MethodGet, Path: "/access/users", Delay: 2 * time.Second})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		start := time.Now()
+		_, err := client.GetUser(ctx, testUser, testRealm)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("Transient Failures Are Retried", func(t *testing.T) {
+		_, _, fake := getTestBackend(t)
+		client := testFakeClient(t, fake)
+
+		fake.inject(fakeFault{
+			Method: http.MethodPost,
+			Path:   "/access/roles",
+			Status: http.StatusInternalServerError,
+			Reason: "cfs-lock 'file-user_cfg' error: got lock request timeout",
+			Times:  2,
+		})
+
+		err := client.CreateRole(context.Background(), "vault-retried", []string{"VM.Audit"})
+		require.NoError(t, err)
+		require.True(t, fake.hasRole("vault-retried"))
+		require.Len(t, fake.requestLog(), 3)
+	})
+
+	t.Run("Gives Up After Max Attempts", func(t *testing.T) {
+		_, _, fake := getTestBackend(t)
+		client := testFakeClient(t, fake)
+
+		fake.inject(fakeFault{Method: http.MethodGet, Path: "/version", Status: http.StatusBadGateway, Reason: "Bad Gateway"})
+
+		_, err := client.Version(context.Background())
+		require.Error(t, err)
+		require.Len(t, fake.requestLog(), defaultMaxAttempts)
+	})
+
+	t.Run("Validation Errors Are Not Retried", func(t *testing.T) {
+		_, _, fake := getTestBackend(t)
+		client := testFakeClient(t, fake)
+
+		fake.inject(fakeFault{Method: http.MethodPut, Path: "/access/acl", Status: http.StatusBadRequest, Reason: "Parameter verification failed."})
+
+		err := client.SetTokenACLs(context.Background(), user, realm, token_id, []proxmoxACLEntry{{Path: "/", Role: "PVEAuditor"}})
+		require.Error(t, err)
+		require.Len(t, fake.requestLog(), 1)
+	})
+
+	t.Run("Token Creation With Unknown Outcome Is Not Retried", func(t *testing.T) {
+		_, _, fake := getTestBackend(t)
+		fake.addUser(formatUserID(testUser, testRealm))
+		client := testFakeClient(t, fake)
+
+		fake.inject(fakeFault{Method: http.MethodPost, Path: "/access/users/", Status: http.StatusInternalServerError, Reason: "Internal Server Error"})
+
+		_, err := client.CreateToken(context.Background(), testUser, testRealm, "unknown", vaultComment, 0, false)
+		require.Error(t, err)
+		require.Len(t, fake.requestLog(), 1)
+	})
+
+	t.Run("Backoff", func(t *testing.T) {
+		for attempt := 1; attempt <= 10; attempt++ {
+			delay := retryBackoff(defaultRetryDelay, attempt)
+
+			ceiling := defaultRetryDelay << (attempt - 1)
+			if ceiling > maxRetryDelay {
+				ceiling = maxRetryDelay
+			}
+
+			require.GreaterOrEqual(t, delay, ceiling/2)
+			require.LessOrEqual(t, delay, ceiling)
+		}
+	})
+
+	t.Run("HTTP Headers", func(t *testing.T) {
+		_, err := parseHTTPHeaders("X-One,1,X-Two")
+		require.Error(t, err)
+
+		headers, err := parseHTTPHeaders("X-One,1,X-Two,2")
+		require.NoError(t, err)
+		require.Equal(t, "1", headers.Get("X-One"))
+		require.Equal(t, "2", headers.Get("X-Two"))
+	})
+}
+
+// closingClient counts how often the idle connections of a client are closed
+type closingClient struct {
+	proxmoxClient
+	closed *int
+}
+
+func (c *closingClient) CloseIdleConnections() {
+	*c.closed++
+	c.proxmoxClient.CloseIdleConnections()
+}
+
+func TestClientReset(t *testing.T) {
+	b, s, fake := getTestBackend(t)
+
+	closed := 0
+	b.newClient = func(config *proxmoxConfig) (proxmoxClient, error) {
+		client, err := newClient(config)
+		return &closingClient{proxmoxClient: client, closed: &closed}, err
+	}
+
+	// the client verifying the connection is only used once
+	testFakeConnection(t, b, s, defaultConnectionName, fake)
+	require.Equal(t, 1, closed)
+
+	_, err := b.getClient(context.Background(), s, defaultConnectionName)
+	require.NoError(t, err)
+
+	b.invalidate(context.Background(), configStoragePath)
+	require.Equal(t, 2, closed)
+
+	// nothing is cached any more
+	b.invalidate(context.Background(), configStoragePath)
+	require.Equal(t, 2, closed)
+
+	_, err = b.getClient(context.Background(), s, defaultConnectionName)
+	require.NoError(t, err)
+
+	b.clean(context.Background())
+	require.Equal(t, 3, closed)
+}
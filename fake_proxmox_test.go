@@ -0,0 +1,760 @@
+package proxmox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	fakeProxmoxVersion = "8.0.4"
+	fakeProxmoxPrefix  = "/api2/json"
+)
+
+// fakeProxmox is an in-memory Proxmox cluster serving the /access and /version endpoints used by the engine.
+// It starts out with the user and token of the test configuration, with every privilege on every path.
+type fakeProxmox struct {
+	*httptest.Server
+
+	lock        sync.Mutex
+	realms      []string
+	users       map[string]*fakeUser
+	acls        []fakeACL
+	roles       map[string][]string
+	permissions map[string]map[string]int
+	faults      []*fakeFault
+	requests    []string
+}
+
+type fakeUser struct {
+	Enable   bool
+	Expire   int64
+	Comment  string
+	Groups   []string
+	Password string
+	Tokens   map[string]*fakeToken
+}
+
+type fakeToken struct {
+	Comment string
+	Expire  int64
+	Privsep bool
+	Secret  string
+}
+
+type fakeACL struct {
+	Path      string
+	Type      string
+	UGID      string
+	RoleID    string
+	Propagate bool
+}
+
+// fakeFault makes the fake fail requests with the given method and a path below /api2/json starting with Path
+type fakeFault struct {
+	Method string
+	Path   string
+	Status int
+	Reason string
+	Delay  time.Duration
+
+	// Times is how many requests fail, all of them fail if it is 0
+	Times int
+}
+
+// fakeError is returned by handlers, Proxmox reports errors in the status line rather than the body
+type fakeError struct {
+	Status int
+	Reason string
+}
+
+func (e *fakeError) Error() string {
+	return fmt.Sprintf("%d %s", e.Status, e.Reason)
+}
+
+func newFakeProxmox(tb testing.TB) *fakeProxmox {
+	tb.Helper()
+
+	f := &fakeProxmox{
+		realms: []string{"pam", "pve"},
+		users: map[string]*fakeUser{
+			formatUserID(user, realm): {
+				Enable: true,
+				Tokens: map[string]*fakeToken{
+					token_id: {Secret: token_secret},
+				},
+			},
+		},
+		roles: make(map[string][]string),
+		permissions: map[string]map[string]int{
+			"/":       {"Permissions.Modify": 1, "Realm.AllocateUser": 1, "Sys.Audit": 1, "Sys.Modify": 1, "User.Modify": 1},
+			"/access": {"Permissions.Modify": 1, "Realm.AllocateUser": 1, "Sys.Audit": 1, "Sys.Modify": 1, "User.Modify": 1},
+		},
+	}
+
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(f.serveHTTP))
+	tb.Cleanup(f.Server.Close)
+
+	return f
+}
+
+// apiURL is the proxmox_url of the fake
+func (f *fakeProxmox) apiURL() string {
+	return f.URL + fakeProxmoxPrefix
+}
+
+// fingerprint is what to pin in tls_fingerprints to trust the fake
+func (f *fakeProxmox) fingerprint() string {
+	return certificateFingerprint(f.Certificate().Raw)
+}
+
+// addUser adds a user, enabled and without expiry
+func (f *fakeProxmox) addUser(userID string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.users[userID] = &fakeUser{Enable: true, Tokens: make(map[string]*fakeToken)}
+}
+
+// addToken adds a token to an existing user, without expiry or privilege separation
+func (f *fakeProxmox) addToken(userID string, tokenID string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.users[userID].Tokens[tokenID] = &fakeToken{Secret: uuid.New().String()}
+}
+
+// setUserStatus enables or disables an existing user and sets when it expires
+func (f *fakeProxmox) setUserStatus(userID string, enable bool, expire int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.users[userID].Enable = enable
+	f.users[userID].Expire = expire
+}
+
+// removeToken deletes a token behind Vault's back, like someone using the Proxmox web UI
+func (f *fakeProxmox) removeToken(userID string, tokenID string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.users[userID].Tokens, tokenID)
+}
+
+// user returns a copy of a user, or nil if it doesn't exist
+func (f *fakeProxmox) user(userID string) *fakeUser {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	u, ok := f.users[userID]
+	if !ok {
+		return nil
+	}
+
+	userCopy := *u
+	return &userCopy
+}
+
+// token returns a copy of a token, or nil if it or its user doesn't exist
+func (f *fakeProxmox) token(userID string, tokenID string) *fakeToken {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	u, ok := f.users[userID]
+	if !ok {
+		return nil
+	}
+
+	t, ok := u.Tokens[tokenID]
+	if !ok {
+		return nil
+	}
+
+	tokenCopy := *t
+	return &tokenCopy
+}
+
+// tokenACLs returns the ACL entries granted directly to a token
+func (f *fakeProxmox) tokenACLs(fullTokenID string) []fakeACL {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var acls []fakeACL
+	for _, acl := range f.acls {
+		if acl.Type == "token" && acl.UGID == fullTokenID {
+			acls = append(acls, acl)
+		}
+	}
+
+	return acls
+}
+
+// hasRole reports whether a Proxmox role exists
+func (f *fakeProxmox) hasRole(roleID string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	_, ok := f.roles[roleID]
+	return ok
+}
+
+// setPermissions replaces the privileges the configured token has on a path
+func (f *fakeProxmox) setPermissions(path string, privileges ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.permissions[path] = make(map[string]int)
+	for _, privilege := range privileges {
+		f.permissions[path][privilege] = 1
+	}
+}
+
+// permissionsOn returns the privileges the configured token has on a path, inherited from the closest parent
+// they are set on like propagated ACLs
+func (f *fakeProxmox) permissionsOn(p string) map[string]int {
+	for {
+		if privileges, ok := f.permissions[p]; ok {
+			return privileges
+		}
+
+		if p == "/" {
+			return nil
+		}
+
+		if i := strings.LastIndex(p, "/"); i > 0 {
+			p = p[:i]
+		} else {
+			p = "/"
+		}
+	}
+}
+
+// inject makes the fake fail matching requests until the fault is used up
+func (f *fakeProxmox) inject(fault fakeFault) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.faults = append(f.faults, &fault)
+}
+
+// requestLog returns the requests served so far, as "<method> <path>"
+func (f *fakeProxmox) requestLog() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeProxmox) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, fakeProxmoxPrefix)
+
+	if err := r.ParseForm(); err != nil {
+		writeFakeResponse(w, nil, &fakeError{Status: http.StatusBadRequest, Reason: err.Error()})
+		return
+	}
+
+	f.lock.Lock()
+	f.requests = append(f.requests, r.Method+" "+path)
+	fault := f.matchFault(r.Method, path)
+	f.lock.Unlock()
+
+	if fault != nil {
+		time.Sleep(fault.Delay)
+		if fault.Status != 0 {
+			writeFakeResponse(w, nil, &fakeError{Status: fault.Status, Reason: fault.Reason})
+			return
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// tickets are requested with a password rather than a token
+	if r.Method == http.MethodPost && path == "/access/ticket" {
+		data, err := f.createTicket(r)
+		writeFakeResponse(w, data, err)
+		return
+	}
+
+	if err := f.authenticate(r); err != nil {
+		writeFakeResponse(w, nil, err)
+		return
+	}
+
+	data, err := f.route(r, path)
+	writeFakeResponse(w, data, err)
+}
+
+func (f *fakeProxmox) matchFault(method string, path string) *fakeFault {
+	for i, fault := range f.faults {
+		if fault.Method != method || !strings.HasPrefix(path, fault.Path) {
+			continue
+		}
+
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				f.faults = append(f.faults[:i], f.faults[i+1:]...)
+			}
+		}
+
+		return fault
+	}
+
+	return nil
+}
+
+func (f *fakeProxmox) authenticate(r *http.Request) error {
+	unauthorized := &fakeError{Status: http.StatusUnauthorized, Reason: "authentication failure"}
+
+	credentials, ok := strings.CutPrefix(r.Header.Get("Authorization"), "PVEAPIToken=")
+	if !ok {
+		return unauthorized
+	}
+
+	fullTokenID, secret, ok := strings.Cut(credentials, "=")
+	if !ok {
+		return unauthorized
+	}
+
+	userID, tokenID, ok := strings.Cut(fullTokenID, "!")
+	if !ok {
+		return unauthorized
+	}
+
+	now := time.Now().Unix()
+
+	u, ok := f.users[userID]
+	if !ok || !u.Enable || (u.Expire != 0 && u.Expire < now) {
+		return unauthorized
+	}
+
+	t, ok := u.Tokens[tokenID]
+	if !ok || t.Secret != secret || (t.Expire != 0 && t.Expire < now) {
+		return unauthorized
+	}
+
+	return nil
+}
+
+func (f *fakeProxmox) route(r *http.Request, path string) (interface{}, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case path == "/version" && r.Method == http.MethodGet:
+		return map[string]interface{}{"version": fakeProxmoxVersion, "release": "8.0", "repoid": "fake"}, nil
+
+	case path == "/access/domains" && r.Method == http.MethodGet:
+		domains := make([]interface{}, 0, len(f.realms))
+		for _, realm := range f.realms {
+			domains = append(domains, map[string]interface{}{"realm": realm, "type": realm})
+		}
+		return domains, nil
+
+	case path == "/access/permissions" && r.Method == http.MethodGet:
+		p := r.Form.Get("path")
+		return map[string]interface{}{p: f.permissionsOn(p)}, nil
+
+	case path == "/access/password" && r.Method == http.MethodPut:
+		u, err := f.getUser(r.Form.Get("userid"))
+		if err != nil {
+			return nil, err
+		}
+		u.Password = r.Form.Get("password")
+		return nil, nil
+
+	case path == "/access/acl":
+		return f.routeACL(r)
+
+	case path == "/access/roles" || (len(parts) == 3 && parts[1] == "roles"):
+		return f.routeRoles(r, parts)
+
+	case path == "/access/users":
+		return f.routeUsers(r)
+
+	case len(parts) == 3 && parts[1] == "users":
+		return f.routeUser(r, parts[2])
+
+	case len(parts) == 4 && parts[1] == "users" && parts[3] == "token" && r.Method == http.MethodGet:
+		u, err := f.getUser(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		tokens := make([]interface{}, 0, len(u.Tokens))
+		for _, tokenID := range sortedKeys(u.Tokens) {
+			tokens = append(tokens, u.Tokens[tokenID].toAPI(tokenID))
+		}
+		return tokens, nil
+
+	case len(parts) == 5 && parts[1] == "users" && parts[3] == "token":
+		return f.routeToken(r, parts[2], parts[4])
+	}
+
+	return nil, &fakeError{Status: http.StatusNotImplemented, Reason: fmt.Sprintf("Method '%s %s' not implemented", r.Method, path)}
+}
+
+func (f *fakeProxmox) getUser(userID string) (*fakeUser, error) {
+	u, ok := f.users[userID]
+	if !ok {
+		return nil, &fakeError{Status: http.StatusInternalServerError, Reason: fmt.Sprintf("no such user ('%s')", userID)}
+	}
+	return u, nil
+}
+
+func (f *fakeProxmox) routeUsers(r *http.Request) (interface{}, error) {
+	switch r.Method {
+	case http.MethodGet:
+		users := make([]interface{}, 0, len(f.users))
+		for _, userID := range sortedKeys(f.users) {
+			entry := f.users[userID].toAPI()
+			entry["userid"] = userID
+			users = append(users, entry)
+		}
+		return users, nil
+
+	case http.MethodPost:
+		userID := r.Form.Get("userid")
+		if _, ok := f.users[userID]; ok {
+			return nil, &fakeError{Status: http.StatusInternalServerError, Reason: fmt.Sprintf("create user failed: user '%s' already exists", userID)}
+		}
+
+		_, userRealm, err := splitUserID(userID)
+		if err != nil || !containsString(f.realms, userRealm) {
+			return nil, &fakeError{Status: http.StatusBadRequest, Reason: "Parameter verification failed."}
+		}
+
+		u := &fakeUser{
+			Enable:   r.Form.Get("enable") != "0",
+			Comment:  r.Form.Get("comment"),
+			Password: r.Form.Get("password"),
+			Tokens:   make(map[string]*fakeToken),
+		}
+		u.Expire, _ = strconv.ParseInt(r.Form.Get("expire"), 10, 64)
+		if groups := r.Form.Get("groups"); groups != "" {
+			u.Groups = strings.Split(groups, ",")
+		}
+
+		f.users[userID] = u
+		return nil, nil
+	}
+
+	return nil, &fakeError{Status: http.StatusNotImplemented, Reason: "Method not implemented"}
+}
+
+func (f *fakeProxmox) routeUser(r *http.Request, userID string) (interface{}, error) {
+	u, err := f.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entry := u.toAPI()
+		tokens := make(map[string]interface{})
+		for tokenID, t := range u.Tokens {
+			tokens[tokenID] = t.toAPI("")
+		}
+		entry["tokens"] = tokens
+		return entry, nil
+
+	case http.MethodPut:
+		if expire := r.Form.Get("expire"); expire != "" {
+			u.Expire, _ = strconv.ParseInt(expire, 10, 64)
+		}
+		if enable := r.Form.Get("enable"); enable != "" {
+			u.Enable = enable != "0"
+		}
+		if comment, ok := r.Form["comment"]; ok {
+			u.Comment = comment[0]
+		}
+		return nil, nil
+
+	case http.MethodDelete:
+		delete(f.users, userID)
+		f.removeACLs(func(acl fakeACL) bool {
+			return acl.UGID == userID || strings.HasPrefix(acl.UGID, userID+"!")
+		})
+		return nil, nil
+	}
+
+	return nil, &fakeError{Status: http.StatusNotImplemented, Reason: "Method not implemented"}
+}
+
+func (f *fakeProxmox) routeToken(r *http.Request, userID string, tokenID string) (interface{}, error) {
+	u, err := f.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := u.Tokens[tokenID]
+	if !ok && r.Method != http.MethodPost {
+		return nil, &fakeError{Status: http.StatusInternalServerError, Reason: fmt.Sprintf("no such token '%s' for user '%s'", tokenID, userID)}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		return t.toAPI(""), nil
+
+	case http.MethodPost:
+		if ok {
+			return nil, &fakeError{Status: http.StatusInternalServerError, Reason: "Token already exists."}
+		}
+		if !tokenIDRegex.MatchString(tokenID) {
+			return nil, &fakeError{Status: http.StatusBadRequest, Reason: "Parameter verification failed."}
+		}
+
+		t = &fakeToken{
+			Comment: r.Form.Get("comment"),
+			Privsep: r.Form.Get("privsep") != "0",
+			Secret:  uuid.New().String(),
+		}
+		t.Expire, _ = strconv.ParseInt(r.Form.Get("expire"), 10, 64)
+		u.Tokens[tokenID] = t
+
+		return map[string]interface{}{
+			"full-tokenid": userID + "!" + tokenID,
+			"info":         t.toAPI(""),
+			"value":        t.Secret,
+		}, nil
+
+	case http.MethodPut:
+		if expire := r.Form.Get("expire"); expire != "" {
+			t.Expire, _ = strconv.ParseInt(expire, 10, 64)
+		}
+		if privsep := r.Form.Get("privsep"); privsep != "" {
+			t.Privsep = privsep != "0"
+		}
+		if comment, ok := r.Form["comment"]; ok {
+			t.Comment = comment[0]
+		}
+		return t.toAPI(""), nil
+
+	case http.MethodDelete:
+		delete(u.Tokens, tokenID)
+		fullTokenID := userID + "!" + tokenID
+		f.removeACLs(func(acl fakeACL) bool {
+			return acl.UGID == fullTokenID
+		})
+		return nil, nil
+	}
+
+	return nil, &fakeError{Status: http.StatusNotImplemented, Reason: "Method not implemented"}
+}
+
+func (f *fakeProxmox) routeACL(r *http.Request) (interface{}, error) {
+	switch r.Method {
+	case http.MethodGet:
+		acls := make([]interface{}, 0, len(f.acls))
+		for _, acl := range f.acls {
+			acls = append(acls, map[string]interface{}{
+				"path":      acl.Path,
+				"type":      acl.Type,
+				"ugid":      acl.UGID,
+				"roleid":    acl.RoleID,
+				"propagate": boolToInt(acl.Propagate),
+			})
+		}
+		return acls, nil
+
+	case http.MethodPut:
+		path := r.Form.Get("path")
+		propagate := r.Form.Get("propagate") != "0"
+
+		var ugids []fakeACL
+		for _, kind := range []struct{ field, aclType string }{{"users", "user"}, {"groups", "group"}, {"tokens", "token"}} {
+			for _, ugid := range strings.Split(r.Form.Get(kind.field), ",") {
+				if ugid != "" {
+					ugids = append(ugids, fakeACL{Path: path, Type: kind.aclType, UGID: ugid})
+				}
+			}
+		}
+
+		for _, roleID := range strings.Split(r.Form.Get("roles"), ",") {
+			if _, ok := f.roles[roleID]; !ok && !strings.HasPrefix(roleID, "PVE") && roleID != "Administrator" {
+				return nil, &fakeError{Status: http.StatusInternalServerError, Reason: fmt.Sprintf("role '%s' does not exist", roleID)}
+			}
+
+			for _, acl := range ugids {
+				acl.RoleID = roleID
+				acl.Propagate = propagate
+
+				f.removeACLs(func(existing fakeACL) bool {
+					return existing.Path == acl.Path && existing.UGID == acl.UGID && existing.RoleID == acl.RoleID
+				})
+				if r.Form.Get("delete") != "1" {
+					f.acls = append(f.acls, acl)
+				}
+			}
+		}
+		return nil, nil
+	}
+
+	return nil, &fakeError{Status: http.StatusNotImplemented, Reason: "Method not implemented"}
+}
+
+func (f *fakeProxmox) routeRoles(r *http.Request, parts []string) (interface{}, error) {
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		roles := make([]interface{}, 0, len(f.roles))
+		for _, roleID := range sortedKeys(f.roles) {
+			roles = append(roles, map[string]interface{}{
+				"roleid":  roleID,
+				"privs":   strings.Join(f.roles[roleID], ","),
+				"special": 0,
+			})
+		}
+		return roles, nil
+
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		roleID := r.Form.Get("roleid")
+		if _, ok := f.roles[roleID]; ok {
+			return nil, &fakeError{Status: http.StatusInternalServerError, Reason: fmt.Sprintf("create role failed: role '%s' already exists", roleID)}
+		}
+		f.roles[roleID] = strings.Split(r.Form.Get("privs"), ",")
+		return nil, nil
+
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		if _, ok := f.roles[parts[2]]; !ok {
+			return nil, &fakeError{Status: http.StatusInternalServerError, Reason: fmt.Sprintf("delete role failed: role '%s' does not exist", parts[2])}
+		}
+		delete(f.roles, parts[2])
+		f.removeACLs(func(acl fakeACL) bool {
+			return acl.RoleID == parts[2]
+		})
+		return nil, nil
+	}
+
+	return nil, &fakeError{Status: http.StatusNotImplemented, Reason: "Method not implemented"}
+}
+
+func (f *fakeProxmox) createTicket(r *http.Request) (interface{}, error) {
+	userID := r.Form.Get("username")
+
+	u, ok := f.users[userID]
+	if !ok || !u.Enable || u.Password == "" || u.Password != r.Form.Get("password") {
+		return nil, &fakeError{Status: http.StatusUnauthorized, Reason: "authentication failure"}
+	}
+
+	return map[string]interface{}{
+		"username":            userID,
+		"ticket":              "PVE:" + userID + ":" + uuid.New().String(),
+		"CSRFPreventionToken": uuid.New().String(),
+	}, nil
+}
+
+func (f *fakeProxmox) removeACLs(match func(fakeACL) bool) {
+	acls := f.acls[:0]
+	for _, acl := range f.acls {
+		if !match(acl) {
+			acls = append(acls, acl)
+		}
+	}
+	f.acls = acls
+}
+
+func (u *fakeUser) toAPI() map[string]interface{} {
+	return map[string]interface{}{
+		"enable":  boolToInt(u.Enable),
+		"expire":  u.Expire,
+		"comment": u.Comment,
+		"groups":  append([]string{}, u.Groups...),
+	}
+}
+
+func (t *fakeToken) toAPI(tokenID string) map[string]interface{} {
+	entry := map[string]interface{}{
+		"comment": t.Comment,
+		"expire":  t.Expire,
+		"privsep": boolToInt(t.Privsep),
+	}
+	if tokenID != "" {
+		entry["tokenid"] = tokenID
+	}
+	return entry
+}
+
+// writeFakeResponse writes data the way Proxmox does, wrapped in "data". Errors are reported in the status
+// line, which net/http only lets handlers set by taking over the connection.
+func writeFakeResponse(w http.ResponseWriter, data interface{}, err error) {
+	body, _ := json.Marshal(map[string]interface{}{"data": data})
+
+	fakeErr, ok := err.(*fakeError)
+	if err != nil && !ok {
+		fakeErr = &fakeError{Status: http.StatusInternalServerError, Reason: err.Error()}
+	}
+
+	if fakeErr == nil {
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		w.Write(body)
+		return
+	}
+
+	conn, buf, hijackErr := w.(http.Hijacker).Hijack()
+	if hijackErr != nil {
+		http.Error(w, fakeErr.Reason, fakeErr.Status)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\nContent-Type: application/json;charset=UTF-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		fakeErr.Status, fakeErr.Reason, len(body), body)
+	buf.Flush()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// testFakeConnection configures a connection to a fake Proxmox, trusting it through its fingerprint
+func testFakeConnection(t *testing.T, b *proxmoxBackend, s logical.Storage, name string, fake *fakeProxmox) {
+	t.Helper()
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      configStorageKey(name),
+		Data: map[string]interface{}{
+			"user":             user,
+			"realm":            realm,
+			"token_id":         token_id,
+			"token_secret":     token_secret,
+			"proxmox_url":      fake.apiURL(),
+			"tls_fingerprints": fake.fingerprint(),
+		},
+		Storage: s,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
@@ -11,25 +13,121 @@ import (
 )
 
 const (
-	configStoragePath = "config"
+	configStoragePath     = "config"
+	defaultConnectionName = "default"
 )
 
+// optionalConnectionRegex matches an optional connection name following a path, leaving it empty for the default connection
+var optionalConnectionRegex = "(/" + framework.GenericNameRegex("name") + ")?"
+
+// connectionNameRegex allows the same names for connections as for roles
+var connectionNameRegex = regexp.MustCompile("^" + framework.GenericNameRegex("name") + "$")
+
+// reservedConnectionNames are taken by the paths next to config/<name>
+var reservedConnectionNames = []string{"rotate-root", "fingerprint", "auto-tidy"}
+
+// proxmoxConfig is the configuration of a connection. Options added over time are read through accessors,
+// which give configurations stored before an option existed its default.
 type proxmoxConfig struct {
-	User               string        `json:"user"`
-	Realm              string        `json:"realm"`
-	ApiTokenID         string        `json:"token_id"`
-	ApiTokenSecret     string        `json:"token_secret"`
-	ApiURL             string        `json:"proxmox_url"`
-	SkipCertValidation bool          `json:"insecure_skip_tls_verify"`
-	HTTPHeaders        string        `json:"http_headers"`
-	ProxyServer        string        `json:"proxy_server"`
-	TaskTimeout        time.Duration `json:"timeout"`
+	User               string         `json:"user"`
+	Realm              string         `json:"realm"`
+	ApiTokenID         string         `json:"token_id"`
+	ApiTokenSecret     string         `json:"token_secret"`
+	ApiURL             string         `json:"proxmox_url"`
+	SkipCertValidation bool           `json:"insecure_skip_tls_verify"`
+	HTTPHeaders        string         `json:"http_headers"`
+	ProxyServer        string         `json:"proxy_server"`
+	TaskTimeout        time.Duration  `json:"timeout"`
+	RotationPeriod     time.Duration  `json:"rotation_period"`
+	LastRotated        time.Time      `json:"last_rotated"`
+	CACert             string         `json:"ca_cert"`
+	TLSServerName      string         `json:"tls_server_name"`
+	TLSMinVersion      string         `json:"tls_min_version"`
+	ClientCert         string         `json:"client_cert"`
+	ClientKey          string         `json:"client_key"`
+	TLSFingerprints    []string       `json:"tls_fingerprints"`
+	TokenExpiryGrace   *time.Duration `json:"token_expiry_grace,omitempty"`
+	MaxAttempts        int            `json:"max_attempts"`
+	VerifyRevocation   bool           `json:"verify_revocation"`
+}
+
+// tlsMinVersion returns the minimum TLS version
+func (c *proxmoxConfig) tlsMinVersion() string {
+	if c.TLSMinVersion == "" {
+		return defaultTLSMinVersion
+	}
+	return c.TLSMinVersion
+}
+
+// tokenExpiryGrace returns how long after the end of their lease tokens expire
+func (c *proxmoxConfig) tokenExpiryGrace() time.Duration {
+	if c.TokenExpiryGrace == nil {
+		return defaultTokenExpiryGrace
+	}
+	return *c.TokenExpiryGrace
+}
+
+// maxAttempts returns how often a request is tried
+func (c *proxmoxConfig) maxAttempts() int {
+	if c.MaxAttempts == 0 {
+		return defaultMaxAttempts
+	}
+	return c.MaxAttempts
+}
+
+// connectionName returns the connection a request is for, from an optional "name" field
+func connectionName(data *framework.FieldData) string {
+	if name, ok := data.GetOk("name"); ok && name.(string) != "" {
+		return name.(string)
+	}
+	return defaultConnectionName
+}
+
+// validateConnectionName returns an error if a connection can't be given a name
+func validateConnectionName(name string) error {
+	if !connectionNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid connection name %q", name)
+	}
+
+	for _, reserved := range reservedConnectionNames {
+		if name == reserved {
+			return fmt.Errorf("connection name %q is reserved", name)
+		}
+	}
+
+	return nil
+}
+
+// configStorageKey returns the storage key of a connection, the default connection is kept where
+// a single configuration was stored before named connections existed
+func configStorageKey(name string) string {
+	if name == "" || name == defaultConnectionName {
+		return configStoragePath
+	}
+	return configStoragePath + "/" + name
+}
+
+func pathConfigList(b *proxmoxBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/$",
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathConfigList,
+			},
+		},
+		HelpSynopsis:    pathConfigListHelpSynopsis,
+		HelpDescription: pathConfigListHelpDescription,
+	}
 }
 
 func pathConfig(b *proxmoxBackend) *framework.Path {
 	return &framework.Path{
-		Pattern: "config",
+		Pattern: "config" + optionalConnectionRegex,
 		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the connection, leave out for the default connection",
+			},
 			"user": {
 				Type:        framework.TypeString,
 				Description: "User that configured API token is for, e.g. root",
@@ -108,6 +206,100 @@ func pathConfig(b *proxmoxBackend) *framework.Path {
 					Name: "Task Timeout",
 				},
 			},
+			"rotation_period": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How often the API token is rotated automatically, see config/rotate-root. If not set or set to 0, the token is only rotated manually.",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Root Token Rotation Period",
+				},
+			},
+			"token_expiry_grace": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How long after the end of their lease tokens expire in Proxmox, in case revoking them in Vault fails. Default is 5m.",
+				Required:    false,
+				Default:     int(defaultTokenExpiryGrace.Seconds()),
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Token Expiry Grace Period",
+				},
+			},
+			"max_attempts": {
+				Type:        framework.TypeInt,
+				Description: "How often a request failing with a transient error is tried before giving up, 1 disables retries. Default is 4.",
+				Required:    false,
+				Default:     defaultMaxAttempts,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Max Attempts",
+				},
+			},
+			"verify_revocation": {
+				Type:        framework.TypeBool,
+				Description: "Check that tokens are gone from Proxmox after revoking them, failing the revocation if they aren't",
+				Required:    false,
+				Default:     false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Verify Revocation",
+				},
+			},
+			"ca_cert": {
+				Type:        framework.TypeString,
+				Description: "PEM encoded CA certificates to verify the Proxmox API certificate against instead of the system trust store",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "CA Certificate",
+				},
+			},
+			"tls_server_name": {
+				Type:        framework.TypeString,
+				Description: "Name to use as SNI and to verify the Proxmox API certificate against, if it differs from the host in proxmox_url",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "TLS Server Name",
+				},
+			},
+			"tls_min_version": {
+				Type:        framework.TypeString,
+				Description: "Minimum TLS version to use, one of tls10, tls11, tls12 or tls13",
+				Required:    false,
+				Default:     defaultTLSMinVersion,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Minimum TLS Version",
+				},
+			},
+			"client_cert": {
+				Type:        framework.TypeString,
+				Description: "PEM encoded client certificate to present to the Proxmox API, e.g. for an mTLS reverse proxy. Requires client_key.",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Client Certificate",
+				},
+			},
+			"client_key": {
+				Type:        framework.TypeString,
+				Description: "PEM encoded private key of client_cert",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name:      "Client Key",
+					Sensitive: true,
+				},
+			},
+			"verify_connection": {
+				Type:        framework.TypeBool,
+				Description: "Check that the Proxmox API can be reached and the token has the privileges needed by this engine before storing the configuration",
+				Required:    false,
+				Default:     true,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "Verify Connection",
+				},
+			},
+			"tls_fingerprints": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "SHA-256 fingerprints of the Proxmox API certificate, as shown by the Proxmox web UI or config/fingerprint. If set, only a certificate matching one of them is accepted and no CA is needed.",
+				Required:    false,
+				DisplayAttrs: &framework.DisplayAttributes{
+					Name: "TLS Fingerprints",
+				},
+			},
 		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
@@ -130,7 +322,7 @@ func pathConfig(b *proxmoxBackend) *framework.Path {
 }
 
 func (b *proxmoxBackend) pathConfigExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
-	out, err := req.Storage.Get(ctx, req.Path)
+	out, err := req.Storage.Get(ctx, configStorageKey(connectionName(data)))
 	if err != nil {
 		return false, fmt.Errorf("existence check failed: %w", err)
 	}
@@ -138,12 +330,25 @@ func (b *proxmoxBackend) pathConfigExistenceCheck(ctx context.Context, req *logi
 	return out != nil, nil
 }
 
+func (b *proxmoxBackend) pathConfigList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	connections, err := listConnections(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(connections), nil
+}
+
 func (b *proxmoxBackend) pathConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	c, err := getConfig(ctx, req.Storage)
+	c, err := getConfig(ctx, req.Storage, connectionName(data))
 	if err != nil {
 		return nil, err
 	}
 
+	if c == nil {
+		return nil, nil
+	}
+
 	return &logical.Response{
 		Data: map[string]interface{}{
 			"user":                     c.User,
@@ -154,12 +359,26 @@ func (b *proxmoxBackend) pathConfigRead(ctx context.Context, req *logical.Reques
 			"http_headers":             c.HTTPHeaders,
 			"proxy_server":             c.ProxyServer,
 			"timeout":                  int(c.TaskTimeout.Seconds()),
+			"rotation_period":          int(c.RotationPeriod.Seconds()),
+			"token_expiry_grace":       int(c.tokenExpiryGrace().Seconds()),
+			"max_attempts":             c.maxAttempts(),
+			"verify_revocation":        c.VerifyRevocation,
+			"ca_cert":                  c.CACert,
+			"tls_server_name":          c.TLSServerName,
+			"tls_min_version":          c.tlsMinVersion(),
+			"client_cert":              c.ClientCert,
+			"tls_fingerprints":         c.TLSFingerprints,
 		},
 	}, nil
 }
 
 func (b *proxmoxBackend) pathConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	config, err := getConfig(ctx, req.Storage)
+	name := connectionName(data)
+	if err := validateConnectionName(name); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	config, err := getConfig(ctx, req.Storage, name)
 	if err != nil {
 		return nil, err
 	}
@@ -193,6 +412,7 @@ func (b *proxmoxBackend) pathConfigWrite(ctx context.Context, req *logical.Reque
 
 	if tokenSecret, ok := data.GetOk("token_secret"); ok {
 		config.ApiTokenSecret = tokenSecret.(string)
+		config.LastRotated = time.Now()
 	} else if !ok && createOperation {
 		return nil, fmt.Errorf("missing token_secret in configuration")
 	}
@@ -229,36 +449,169 @@ func (b *proxmoxBackend) pathConfigWrite(ctx context.Context, req *logical.Reque
 		config.TaskTimeout = time.Duration(data.GetDefaultOrZero("timeout").(int)) * time.Second
 	}
 
-	entry, err := logical.StorageEntryJSON(configStoragePath, config)
-	if err != nil {
-		return nil, err
+	if rotationPeriod, ok := data.GetOk("rotation_period"); ok {
+		config.RotationPeriod = time.Duration(rotationPeriod.(int)) * time.Second
+	}
+
+	if config.RotationPeriod != 0 && config.RotationPeriod < minRotationPeriod {
+		return logical.ErrorResponse("rotation_period must be at least %s", minRotationPeriod), nil
+	}
+
+	if graceRaw, ok := data.GetOk("token_expiry_grace"); ok {
+		grace := time.Duration(graceRaw.(int)) * time.Second
+		if grace < 0 {
+			return logical.ErrorResponse("token_expiry_grace can't be negative"), nil
+		}
+		config.TokenExpiryGrace = &grace
+	}
+
+	if maxAttempts, ok := data.GetOk("max_attempts"); ok {
+		config.MaxAttempts = maxAttempts.(int)
+		if config.MaxAttempts < 1 {
+			return logical.ErrorResponse("max_attempts must be at least 1"), nil
+		}
 	}
 
-	if err := req.Storage.Put(ctx, entry); err != nil {
+	if verifyRevocation, ok := data.GetOk("verify_revocation"); ok {
+		config.VerifyRevocation = verifyRevocation.(bool)
+	}
+
+	if caCert, ok := data.GetOk("ca_cert"); ok {
+		config.CACert = caCert.(string)
+	}
+
+	if tlsServerName, ok := data.GetOk("tls_server_name"); ok {
+		config.TLSServerName = tlsServerName.(string)
+	}
+
+	if tlsMinVersion, ok := data.GetOk("tls_min_version"); ok {
+		config.TLSMinVersion = tlsMinVersion.(string)
+	} else if !ok && createOperation {
+		config.TLSMinVersion = data.GetDefaultOrZero("tls_min_version").(string)
+	}
+
+	if clientCert, ok := data.GetOk("client_cert"); ok {
+		config.ClientCert = clientCert.(string)
+	}
+
+	if clientKey, ok := data.GetOk("client_key"); ok {
+		config.ClientKey = clientKey.(string)
+	}
+
+	if fingerprints, ok := data.GetOk("tls_fingerprints"); ok {
+		config.TLSFingerprints = nil
+		for _, fingerprint := range fingerprints.([]string) {
+			normalized, err := normalizeFingerprint(fingerprint)
+			if err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+			config.TLSFingerprints = append(config.TLSFingerprints, normalized)
+		}
+	}
+
+	if _, err := newTLSConfig(config); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if data.Get("verify_connection").(bool) {
+		client, err := b.newClient(config)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		err = verifyConnection(ctx, client)
+		client.CloseIdleConnections()
+		if err != nil {
+			return logical.ErrorResponse("error verifying connection, set verify_connection=false to store the configuration anyway: %s", err), nil
+		}
+	}
+
+	if config.LastRotated.IsZero() {
+		config.LastRotated = time.Now()
+	}
+
+	if err := putConfig(ctx, req.Storage, name, config); err != nil {
 		return nil, err
 	}
 
-	b.reset()
+	b.reset(name)
 
 	return nil, nil
 }
 
 func (b *proxmoxBackend) pathConfigDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	err := req.Storage.Delete(ctx, configStoragePath)
+	name := connectionName(data)
+
+	err := req.Storage.Delete(ctx, configStorageKey(name))
 
 	if err == nil {
-		b.reset()
+		b.reset(name)
 	}
 
 	return nil, err
 }
 
-func getConfig(ctx context.Context, s logical.Storage) (*proxmoxConfig, error) {
+// validateConnection returns an error response if a role refers to a named connection that is not
+// configured, the default connection may still be configured after its roles
+func validateConnection(ctx context.Context, s logical.Storage, name string) (*logical.Response, error) {
+	if name == defaultConnectionName {
+		return nil, nil
+	}
+
+	config, err := getConfig(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		return logical.ErrorResponse("connection %q is not configured", name), nil
+	}
+
+	return nil, nil
+}
+
+// listConnections returns the names of all configured connections
+func listConnections(ctx context.Context, s logical.Storage) ([]string, error) {
+	var connections []string
+
 	entry, err := s.Get(ctx, configStoragePath)
 	if err != nil {
 		return nil, err
 	}
 
+	if entry != nil {
+		connections = append(connections, defaultConnectionName)
+	}
+
+	names, err := s.List(ctx, configStoragePath+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if !strings.HasSuffix(name, "/") && name != defaultConnectionName {
+			connections = append(connections, name)
+		}
+	}
+
+	return connections, nil
+}
+
+func putConfig(ctx context.Context, s logical.Storage, name string, config *proxmoxConfig) error {
+	entry, err := logical.StorageEntryJSON(configStorageKey(name), config)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func getConfig(ctx context.Context, s logical.Storage, name string) (*proxmoxConfig, error) {
+	entry, err := s.Get(ctx, configStorageKey(name))
+	if err != nil {
+		return nil, err
+	}
+
 	if entry == nil {
 		return nil, nil
 	}
@@ -278,4 +631,11 @@ The Proxmox secrets backend requires credentials for managing
 API tokens using the Proxmox API.
 
 You must sign in to your Proxmox cluster and create an API token and give that token to this secrets engine,
-which will be used to mint new short lived tokens.`
+which will be used to mint new short lived tokens.
+
+Several clusters can be managed from one mount by configuring named connections at "config/<name>",
+"config" itself is the connection named "default".`
+
+const pathConfigListHelpSynopsis = `List the configured Proxmox connections.`
+
+const pathConfigListHelpDescription = `Connections will be listed by name, "default" is the one configured at "config".`
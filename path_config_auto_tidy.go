@@ -0,0 +1,164 @@
+package proxmox
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// kept outside of config/ where named connections are stored
+	autoTidyStoragePath = "auto-tidy"
+
+	defaultAutoTidyInterval = 12 * time.Hour
+	minAutoTidyInterval     = 5 * time.Minute
+)
+
+type autoTidyConfig struct {
+	Enabled        bool          `json:"enabled"`
+	Interval       time.Duration `json:"interval"`
+	RemoveOrphaned bool          `json:"remove_orphaned"`
+	LastTidy       time.Time     `json:"last_tidy"`
+}
+
+func pathConfigAutoTidy(b *proxmoxBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/auto-tidy",
+		Fields: map[string]*framework.FieldSchema{
+			"enabled": {
+				Type:        framework.TypeBool,
+				Description: "Run tidy periodically",
+				Default:     false,
+			},
+			"interval": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How often tidy runs when enabled, default is 12h",
+				Default:     int(defaultAutoTidyInterval.Seconds()),
+			},
+			"remove_orphaned": {
+				Type:        framework.TypeBool,
+				Description: "Also remove tokens that don't belong to any lease, see tidy",
+				Default:     false,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathConfigAutoTidyRead,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathConfigAutoTidyWrite,
+			},
+		},
+		HelpSynopsis:    pathConfigAutoTidyHelpSynopsis,
+		HelpDescription: pathConfigAutoTidyHelpDescription,
+	}
+}
+
+func (b *proxmoxBackend) pathConfigAutoTidyRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getAutoTidyConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"enabled":         config.Enabled,
+			"interval":        int(config.Interval.Seconds()),
+			"remove_orphaned": config.RemoveOrphaned,
+			"last_tidy":       config.LastTidy,
+		},
+	}, nil
+}
+
+func (b *proxmoxBackend) pathConfigAutoTidyWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getAutoTidyConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if enabled, ok := data.GetOk("enabled"); ok {
+		config.Enabled = enabled.(bool)
+	}
+
+	if interval, ok := data.GetOk("interval"); ok {
+		config.Interval = time.Duration(interval.(int)) * time.Second
+	}
+
+	if removeOrphaned, ok := data.GetOk("remove_orphaned"); ok {
+		config.RemoveOrphaned = removeOrphaned.(bool)
+	}
+
+	if config.Interval < minAutoTidyInterval {
+		return logical.ErrorResponse("interval must be at least %s", minAutoTidyInterval), nil
+	}
+
+	if err := putAutoTidyConfig(ctx, req.Storage, config); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// tidyIfDue runs tidy if it is enabled and its interval has passed since the last run
+func (b *proxmoxBackend) tidyIfDue(ctx context.Context, s logical.Storage) error {
+	config, err := getAutoTidyConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	if !config.Enabled || time.Now().Before(config.LastTidy.Add(config.Interval)) {
+		return nil
+	}
+
+	// the next run is scheduled even if this one fails, so a broken connection doesn't make tidy run every minute
+	config.LastTidy = time.Now()
+	if err := putAutoTidyConfig(ctx, s, config); err != nil {
+		return err
+	}
+
+	tidied, err := b.tidyTokens(ctx, s, false, config.RemoveOrphaned)
+	if err != nil {
+		b.Logger().Error("error running periodic tidy", "error", err)
+	}
+	b.Logger().Debug("periodic tidy finished", "removed", len(tidied))
+
+	return err
+}
+
+func putAutoTidyConfig(ctx context.Context, s logical.Storage, config *autoTidyConfig) error {
+	entry, err := logical.StorageEntryJSON(autoTidyStoragePath, config)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func getAutoTidyConfig(ctx context.Context, s logical.Storage) (*autoTidyConfig, error) {
+	config := &autoTidyConfig{
+		Interval: defaultAutoTidyInterval,
+	}
+
+	entry, err := s.Get(ctx, autoTidyStoragePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return config, nil
+	}
+
+	if err := entry.DecodeJSON(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+const pathConfigAutoTidyHelpSynopsis = `Configure periodic tidy of leftover API tokens.`
+
+const pathConfigAutoTidyHelpDescription = `
+When enabled, the tidy endpoint is run every interval. See the help of tidy for what is removed.
+`
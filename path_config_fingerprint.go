@@ -0,0 +1,93 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const fingerprintTimeout = 10 * time.Second
+
+func pathConfigFingerprint(b *proxmoxBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config" + optionalConnectionRegex + "/fingerprint",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the connection, leave out for the default connection",
+			},
+			"proxmox_url": {
+				Type:        framework.TypeString,
+				Description: "API endpoint to fetch the certificate from, defaults to the proxmox_url of the connection",
+			},
+			"proxy_server": {
+				Type:        framework.TypeString,
+				Description: "Proxy server to connect through, defaults to the proxy_server of the connection",
+			},
+			"tls_server_name": {
+				Type:        framework.TypeString,
+				Description: "Name to use as SNI, defaults to the tls_server_name of the connection",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathConfigFingerprintRead,
+			},
+		},
+		HelpSynopsis:    pathConfigFingerprintHelpSynopsis,
+		HelpDescription: pathConfigFingerprintHelpDescription,
+	}
+}
+
+func (b *proxmoxBackend) pathConfigFingerprintRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getConfig(ctx, req.Storage, connectionName(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		config = new(proxmoxConfig)
+	}
+
+	if apiURL, ok := data.GetOk("proxmox_url"); ok {
+		config.ApiURL = apiURL.(string)
+	}
+
+	if proxyServer, ok := data.GetOk("proxy_server"); ok {
+		config.ProxyServer = proxyServer.(string)
+	}
+
+	if tlsServerName, ok := data.GetOk("tls_server_name"); ok {
+		config.TLSServerName = tlsServerName.(string)
+	}
+
+	if config.ApiURL == "" {
+		return nil, errors.New("no configuration found, set proxmox_url to fetch a fingerprint before configuring")
+	}
+
+	cert, err := fetchCertificate(ctx, config, fingerprintTimeout)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"proxmox_url": config.ApiURL,
+			"fingerprint": certificateFingerprint(cert.Raw),
+			"subject":     cert.Subject.String(),
+			"issuer":      cert.Issuer.String(),
+			"not_after":   cert.NotAfter.Format(time.RFC3339),
+		},
+	}, nil
+}
+
+const pathConfigFingerprintHelpSynopsis = `Show the certificate fingerprint of the Proxmox API.`
+
+const pathConfigFingerprintHelpDescription = `
+This path connects to the Proxmox API without verifying its certificate, through the proxy
+and with the server name of the connection, and returns the SHA-256 fingerprint of the certificate it presents, to be pinned through tls_fingerprints.
+Compare it with the fingerprint shown in the Proxmox web UI before trusting it.
+`
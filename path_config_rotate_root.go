@@ -0,0 +1,159 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathConfigRotateRoot(b *proxmoxBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config" + optionalConnectionRegex + "/rotate-root",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the connection, leave out for the default connection",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathConfigRotateRootUpdate,
+			},
+		},
+		HelpSynopsis:    pathConfigRotateRootHelpSynopsis,
+		HelpDescription: pathConfigRotateRootHelpDescription,
+	}
+}
+
+func (b *proxmoxBackend) pathConfigRotateRootUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	tokenID, err := b.rotateRoot(ctx, req.Storage, connectionName(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"token_id": tokenID,
+		},
+	}, nil
+}
+
+// rotateRoot replaces the configured API token with a newly created one with the same privileges
+// and returns the new token ID
+func (b *proxmoxBackend) rotateRoot(ctx context.Context, s logical.Storage, connection string) (string, error) {
+	b.rotateRootLock.Lock()
+	defer b.rotateRootLock.Unlock()
+
+	config, err := getConfig(ctx, s, connection)
+	if err != nil {
+		return "", err
+	}
+
+	if config == nil {
+		return "", errors.New("no configuration found to rotate")
+	}
+
+	client, err := b.getClient(ctx, s, connection)
+	if err != nil {
+		return "", err
+	}
+
+	oldToken, err := client.GetToken(ctx, config.User, config.Realm, config.ApiTokenID)
+	if err != nil {
+		return "", fmt.Errorf("error reading current root token: %w", err)
+	}
+
+	acls, err := client.GetTokenACLs(ctx, config.User, config.Realm, config.ApiTokenID)
+	if err != nil {
+		return "", fmt.Errorf("error reading ACLs of current root token: %w", err)
+	}
+
+	newToken, err := client.CreateToken(ctx, config.User, config.Realm, newTokenID(), vaultComment, 0, oldToken.Privsep)
+	if err == nil && newToken == nil {
+		err = errors.New("no token returned")
+	}
+	if err != nil {
+		return "", fmt.Errorf("error creating new root token: %w", err)
+	}
+
+	if len(acls) > 0 {
+		if err := client.SetTokenACLs(ctx, config.User, config.Realm, newToken.TokenID, acls); err != nil {
+			if delErr := client.DeleteToken(ctx, config.User, config.Realm, newToken.TokenID); delErr != nil {
+				b.Logger().Error("error deleting new root token after failing to copy ACLs", "error", delErr)
+			}
+			return "", fmt.Errorf("error copying ACLs to new root token: %w", err)
+		}
+	}
+
+	oldTokenID := config.ApiTokenID
+	config.ApiTokenID = newToken.TokenID
+	config.ApiTokenSecret = newToken.Secret
+	config.LastRotated = time.Now()
+
+	if err := putConfig(ctx, s, connection, config); err != nil {
+		if delErr := client.DeleteToken(ctx, config.User, config.Realm, newToken.TokenID); delErr != nil {
+			b.Logger().Error("error deleting new root token after failing to store it", "error", delErr)
+		}
+		return "", fmt.Errorf("error storing new root token: %w", err)
+	}
+
+	b.reset(connection)
+
+	client, err = b.getClient(ctx, s, connection)
+	if err != nil {
+		return "", fmt.Errorf("error getting client for new root token: %w", err)
+	}
+
+	if err := client.DeleteToken(ctx, config.User, config.Realm, oldTokenID); err != nil {
+		return "", fmt.Errorf("new root token is in use but deleting the old one failed: %w", err)
+	}
+
+	return newToken.TokenID, nil
+}
+
+// rotateRootIfDue rotates the API token of every connection that has passed its rotation period
+func (b *proxmoxBackend) rotateRootIfDue(ctx context.Context, s logical.Storage) error {
+	connections, err := listConnections(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	var errs error
+	for _, connection := range connections {
+		config, err := getConfig(ctx, s, connection)
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+
+		if config == nil || config.RotationPeriod <= 0 {
+			continue
+		}
+
+		if time.Now().Before(config.LastRotated.Add(config.RotationPeriod)) {
+			continue
+		}
+
+		b.Logger().Debug("rotating root token", "connection", connection)
+		if _, err := b.rotateRoot(ctx, s, connection); err != nil {
+			b.Logger().Error("error rotating root token", "connection", connection, "error", err)
+			errs = errors.Join(errs, err)
+		}
+	}
+
+	return errs
+}
+
+const pathConfigRotateRootHelpSynopsis = `Rotate the API token used by Vault to manage Proxmox.`
+
+const pathConfigRotateRootHelpDescription = `
+This path creates a new API token for the configured user, copies the ACLs of the
+current token to it and switches Vault over to it before deleting the old token.
+The new secret is only stored in Vault and is never returned.
+
+Use "config/<name>/rotate-root" to rotate the token of a named connection.
+`
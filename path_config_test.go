@@ -2,8 +2,23 @@ package proxmox
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -19,7 +34,9 @@ const (
 	timeout      = 300
 )
 
-func getTestBackend(tb testing.TB) (*proxmoxBackend, logical.Storage) {
+// getTestBackend returns a backend with in-memory storage and a fake Proxmox to configure connections against,
+// see testFakeConnection
+func getTestBackend(tb testing.TB) (*proxmoxBackend, logical.Storage, *fakeProxmox) {
 	tb.Helper()
 
 	config := logical.TestBackendConfig()
@@ -32,20 +49,21 @@ func getTestBackend(tb testing.TB) (*proxmoxBackend, logical.Storage) {
 		tb.Fatal(err)
 	}
 
-	return b.(*proxmoxBackend), config.StorageView
+	return b.(*proxmoxBackend), config.StorageView, newFakeProxmox(tb)
 }
 
 func TestConfig(t *testing.T) {
-	b, reqStorage := getTestBackend(t)
+	b, reqStorage, _ := getTestBackend(t)
 
 	t.Run("Test Configuration", func(t *testing.T) {
 		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
-			"user":         user,
-			"realm":        realm,
-			"token_id":     token_id,
-			"token_secret": token_secret,
-			"proxmox_url":  url,
-			"timeout":      timeout,
+			"user":              user,
+			"realm":             realm,
+			"token_id":          token_id,
+			"token_secret":      token_secret,
+			"proxmox_url":       url,
+			"timeout":           timeout,
+			"verify_connection": false,
 		})
 
 		assert.NoError(t, err)
@@ -59,13 +77,23 @@ func TestConfig(t *testing.T) {
 			"http_headers":             "",
 			"proxy_server":             "",
 			"timeout":                  timeout,
+			"rotation_period":          0,
+			"token_expiry_grace":       300,
+			"max_attempts":             defaultMaxAttempts,
+			"verify_revocation":        false,
+			"ca_cert":                  "",
+			"tls_server_name":          "",
+			"tls_min_version":          "tls12",
+			"client_cert":              "",
+			"tls_fingerprints":         []string(nil),
 		})
 
 		assert.NoError(t, err)
 
 		err = testConfigUpdate(t, b, reqStorage, map[string]interface{}{
-			"user":     "bob",
-			"token_id": "some_changed_token_703468470",
+			"user":              "bob",
+			"token_id":          "some_changed_token_703468470",
+			"verify_connection": false,
 		})
 
 		assert.NoError(t, err)
@@ -79,6 +107,15 @@ func TestConfig(t *testing.T) {
 			"http_headers":             "",
 			"proxy_server":             "",
 			"timeout":                  timeout,
+			"rotation_period":          0,
+			"token_expiry_grace":       300,
+			"max_attempts":             defaultMaxAttempts,
+			"verify_revocation":        false,
+			"ca_cert":                  "",
+			"tls_server_name":          "",
+			"tls_min_version":          "tls12",
+			"client_cert":              "",
+			"tls_fingerprints":         []string(nil),
 		})
 
 		assert.NoError(t, err)
@@ -89,6 +126,465 @@ func TestConfig(t *testing.T) {
 	})
 }
 
+func TestConfigRotationPeriod(t *testing.T) {
+	b, reqStorage, _ := getTestBackend(t)
+
+	err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+		"user":              user,
+		"realm":             realm,
+		"token_id":          token_id,
+		"token_secret":      token_secret,
+		"proxmox_url":       url,
+		"rotation_period":   "1m",
+		"verify_connection": false,
+	})
+
+	assert.Error(t, err)
+
+	err = testConfigCreate(t, b, reqStorage, map[string]interface{}{
+		"user":              user,
+		"realm":             realm,
+		"token_id":          token_id,
+		"token_secret":      token_secret,
+		"proxmox_url":       url,
+		"rotation_period":   "720h",
+		"verify_connection": false,
+	})
+
+	assert.NoError(t, err)
+
+	config, err := getConfig(context.Background(), reqStorage, defaultConnectionName)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 720*time.Hour, config.RotationPeriod)
+	assert.False(t, config.LastRotated.IsZero())
+
+	// not due yet, so nothing should try to reach Proxmox
+	assert.NoError(t, b.rotateRootIfDue(context.Background(), reqStorage))
+}
+
+func TestConfigConnections(t *testing.T) {
+	b, reqStorage, _ := getTestBackend(t)
+
+	connection := map[string]interface{}{
+		"user":              user,
+		"realm":             realm,
+		"token_id":          token_id,
+		"token_secret":      token_secret,
+		"proxmox_url":       url,
+		"verify_connection": false,
+	}
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      configStoragePath + "/other",
+		Data:      connection,
+		Storage:   reqStorage,
+	})
+
+	assert.NoError(t, err)
+	assert.Nil(t, resp)
+
+	assert.NoError(t, testConfigCreate(t, b, reqStorage, connection))
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      configStoragePath + "/",
+		Storage:   reqStorage,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{defaultConnectionName, "other"}, resp.Data["keys"])
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      configStoragePath + "/other",
+		Storage:   reqStorage,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, user, resp.Data["user"])
+
+	t.Run("Invalidate Only Affects One Connection", func(t *testing.T) {
+		_, err := b.getClient(context.Background(), reqStorage, defaultConnectionName)
+		assert.NoError(t, err)
+		_, err = b.getClient(context.Background(), reqStorage, "other")
+		assert.NoError(t, err)
+
+		b.invalidate(context.Background(), configStoragePath+"/other")
+
+		assert.Contains(t, b.clients, defaultConnectionName)
+		assert.NotContains(t, b.clients, "other")
+
+		b.invalidate(context.Background(), configStoragePath)
+
+		assert.NotContains(t, b.clients, defaultConnectionName)
+	})
+
+	t.Run("Unknown Connection", func(t *testing.T) {
+		_, err := b.getClient(context.Background(), reqStorage, "missing")
+		assert.Error(t, err)
+	})
+
+	t.Run("Reserved Connection Names", func(t *testing.T) {
+		// names are lower cased after the path is routed, so these would end up next to the other config paths
+		for _, name := range []string{"Rotate-Root", "Fingerprint", "Auto-Tidy"} {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.CreateOperation,
+				Path:      configStoragePath + "/" + name,
+				Data:      connection,
+				Storage:   reqStorage,
+			})
+
+			assert.NoError(t, err)
+			assert.True(t, resp.IsError(), name)
+		}
+
+		connections, err := listConnections(context.Background(), reqStorage)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{defaultConnectionName, "other"}, connections)
+	})
+}
+
+func TestConfigMaxAttempts(t *testing.T) {
+	b, reqStorage, _ := getTestBackend(t)
+
+	connection := map[string]interface{}{
+		"user":              user,
+		"realm":             realm,
+		"token_id":          token_id,
+		"token_secret":      token_secret,
+		"proxmox_url":       url,
+		"max_attempts":      0,
+		"verify_connection": false,
+	}
+
+	err := testConfigCreate(t, b, reqStorage, connection)
+	assert.Error(t, err)
+
+	connection["max_attempts"] = 2
+
+	err = testConfigCreate(t, b, reqStorage, connection)
+	assert.NoError(t, err)
+
+	config, err := getConfig(context.Background(), reqStorage, defaultConnectionName)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, config.maxAttempts())
+
+	// configurations stored before retries were configurable get the default
+	config.MaxAttempts = 0
+	assert.Equal(t, defaultMaxAttempts, config.maxAttempts())
+}
+
+func TestConfigTLS(t *testing.T) {
+	b, reqStorage, _ := getTestBackend(t)
+
+	certPEM, keyPEM := testCertificate(t)
+
+	connection := func(d map[string]interface{}) map[string]interface{} {
+		d["user"] = user
+		d["realm"] = realm
+		d["token_id"] = token_id
+		d["token_secret"] = token_secret
+		d["proxmox_url"] = url
+		d["verify_connection"] = false
+		return d
+	}
+
+	t.Run("Invalid CA Certificate", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, connection(map[string]interface{}{
+			"ca_cert": "not a certificate",
+		}))
+		assert.Error(t, err)
+	})
+
+	t.Run("Invalid TLS Version", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, connection(map[string]interface{}{
+			"tls_min_version": "ssl3",
+		}))
+		assert.Error(t, err)
+	})
+
+	t.Run("Client Certificate Without Key", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, connection(map[string]interface{}{
+			"client_cert": certPEM,
+		}))
+		assert.Error(t, err)
+	})
+
+	t.Run("Valid TLS Configuration", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, connection(map[string]interface{}{
+			"ca_cert":         certPEM,
+			"tls_server_name": "pve.example.com",
+			"tls_min_version": "tls13",
+			"client_cert":     certPEM,
+			"client_key":      keyPEM,
+		}))
+		assert.NoError(t, err)
+
+		err = testConfigRead(t, b, reqStorage, map[string]interface{}{
+			"user":                     user,
+			"realm":                    realm,
+			"token_id":                 token_id,
+			"proxmox_url":              url,
+			"insecure_skip_tls_verify": false,
+			"http_headers":             "",
+			"proxy_server":             "",
+			"timeout":                  120,
+			"rotation_period":          0,
+			"token_expiry_grace":       300,
+			"max_attempts":             defaultMaxAttempts,
+			"verify_revocation":        false,
+			"ca_cert":                  certPEM,
+			"tls_server_name":          "pve.example.com",
+			"tls_min_version":          "tls13",
+			"client_cert":              certPEM,
+			"tls_fingerprints":         []string(nil),
+		})
+		assert.NoError(t, err)
+
+		client, err := b.getClient(context.Background(), reqStorage, defaultConnectionName)
+		assert.NoError(t, err)
+		assert.NotNil(t, client)
+	})
+}
+
+func TestConfigFingerprint(t *testing.T) {
+	b, reqStorage, fake := getTestBackend(t)
+
+	expected := fake.fingerprint()
+
+	t.Run("Fetch Fingerprint", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      configStoragePath + "/fingerprint",
+			Data: map[string]interface{}{
+				"proxmox_url": fake.apiURL(),
+			},
+			Storage: reqStorage,
+		})
+
+		assert.NoError(t, err)
+		assert.False(t, resp.IsError())
+		assert.Equal(t, expected, resp.Data["fingerprint"])
+	})
+
+	t.Run("Fetch Through Proxy With Server Name", func(t *testing.T) {
+		serverNames := make(chan string, 1)
+		server := httptest.NewUnstartedServer(http.NotFoundHandler())
+		server.TLS = &tls.Config{
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				serverNames <- hello.ServerName
+				return nil, nil
+			},
+		}
+		server.StartTLS()
+		defer server.Close()
+
+		proxied := make(chan string, 1)
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodConnect {
+				http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+				return
+			}
+			proxied <- r.Host
+
+			upstream, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			defer upstream.Close()
+
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			go func() { _, _ = io.Copy(upstream, conn) }()
+			_, _ = io.Copy(conn, upstream)
+		}))
+		defer proxy.Close()
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      configStoragePath + "/fingerprint",
+			Data: map[string]interface{}{
+				"proxmox_url":     server.URL,
+				"proxy_server":    proxy.URL,
+				"tls_server_name": "pve.example.com",
+			},
+			Storage: reqStorage,
+		})
+
+		assert.NoError(t, err)
+		assert.False(t, resp.IsError())
+		assert.Equal(t, certificateFingerprint(server.Certificate().Raw), resp.Data["fingerprint"])
+		assert.Equal(t, server.Listener.Addr().String(), <-proxied)
+		assert.Equal(t, "pve.example.com", <-serverNames)
+	})
+
+	t.Run("Invalid Fingerprint", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"user":             user,
+			"realm":            realm,
+			"token_id":         token_id,
+			"token_secret":     token_secret,
+			"proxmox_url":      fake.apiURL(),
+			"tls_fingerprints": "AB:CD",
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("Pinned Fingerprint", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, map[string]interface{}{
+			"user":             user,
+			"realm":            realm,
+			"token_id":         token_id,
+			"token_secret":     token_secret,
+			"proxmox_url":      fake.apiURL(),
+			"tls_fingerprints": strings.ToLower(strings.ReplaceAll(expected, ":", "")),
+		})
+		assert.NoError(t, err)
+
+		config, err := getConfig(context.Background(), reqStorage, defaultConnectionName)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{expected}, config.TLSFingerprints)
+
+		tlsConfig, err := newTLSConfig(config)
+		assert.NoError(t, err)
+
+		assert.NoError(t, tlsConfig.VerifyPeerCertificate([][]byte{fake.Certificate().Raw}, nil))
+
+		otherPEM, _ := testCertificate(t)
+		block, _ := pem.Decode([]byte(otherPEM))
+		assert.Error(t, tlsConfig.VerifyPeerCertificate([][]byte{block.Bytes}, nil))
+	})
+}
+
+func TestConfigVerifyConnection(t *testing.T) {
+	b, reqStorage, fake := getTestBackend(t)
+
+	fake.setPermissions("/access", "User.Modify")
+	fake.setPermissions("/")
+
+	connection := map[string]interface{}{
+		"user":              user,
+		"realm":             realm,
+		"token_id":          token_id,
+		"token_secret":      token_secret,
+		"proxmox_url":       fake.apiURL(),
+		"tls_fingerprints":  fake.fingerprint(),
+		"verify_connection": true,
+	}
+
+	t.Run("Missing Privilege", func(t *testing.T) {
+		err := testConfigCreate(t, b, reqStorage, connection)
+
+		assert.ErrorContains(t, err, "token is missing privileges: Permissions.Modify on path '/'")
+
+		config, err := getConfig(context.Background(), reqStorage, defaultConnectionName)
+		assert.NoError(t, err)
+		assert.Nil(t, config)
+	})
+
+	t.Run("All Privileges", func(t *testing.T) {
+		// the privileges of some role features are only checked when a role uses them
+		fake.setPermissions("/", "Permissions.Modify")
+
+		err := testConfigCreate(t, b, reqStorage, connection)
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("Invalid Token", func(t *testing.T) {
+		connection["token_secret"] = "444-555-666"
+
+		err := testConfigUpdate(t, b, reqStorage, connection)
+
+		assert.Error(t, err)
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		connection["token_secret"] = token_secret
+		connection["proxmox_url"] = "https://127.0.0.1:1/api2/json"
+		connection["max_attempts"] = 1
+
+		err := testConfigUpdate(t, b, reqStorage, connection)
+
+		assert.Error(t, err)
+	})
+}
+
+func TestConfigRotateRoot(t *testing.T) {
+	b, reqStorage, fake := getTestBackend(t)
+
+	testFakeConnection(t, b, reqStorage, defaultConnectionName, fake)
+
+	rootUserID := formatUserID(user, realm)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/rotate-root",
+		Storage:   reqStorage,
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+
+	newTokenID := resp.Data["token_id"].(string)
+	assert.NotEqual(t, token_id, newTokenID)
+	assert.Nil(t, fake.token(rootUserID, token_id))
+
+	config, err := getConfig(context.Background(), reqStorage, defaultConnectionName)
+	assert.NoError(t, err)
+	assert.Equal(t, newTokenID, config.ApiTokenID)
+	assert.Equal(t, fake.token(rootUserID, newTokenID).Secret, config.ApiTokenSecret)
+
+	// the engine keeps working with the new token
+	client, err := b.getClient(context.Background(), reqStorage, defaultConnectionName)
+	assert.NoError(t, err)
+	assert.NoError(t, verifyConnection(context.Background(), client))
+}
+
+// testCertificate returns a PEM encoded self-signed certificate and its key
+func testCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pve.example.com"},
+		DNSNames:              []string{"pve.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return string(certPEM), string(keyPEM)
+}
+
 func testConfigDelete(t *testing.T, b logical.Backend, s logical.Storage) error {
 	resp, err := b.HandleRequest(context.Background(), &logical.Request{
 		Operation: logical.DeleteOperation,
@@ -170,7 +666,7 @@ func testConfigRead(t *testing.T, b logical.Backend, s logical.Storage, expected
 
 		if !ok {
 			return fmt.Errorf(`expected data["%s"] = %v but was not included in read output"`, k, expectedV)
-		} else if expectedV != actualV {
+		} else if !reflect.DeepEqual(expectedV, actualV) {
 			return fmt.Errorf(`expected data["%s"] = %v, instead got %v"`, k, expectedV, actualV)
 		}
 	}
@@ -29,49 +29,133 @@ func pathCredentials(b *proxmoxBackend) *framework.Path {
 	}
 }
 
-func (b *proxmoxBackend) createToken(ctx context.Context, s logical.Storage, role *proxmoxRoleEntry) (*proxmoxToken, error) {
-	client, err := b.getClient(ctx, s)
+// createToken creates a token with the given ID for a role, creating user first if the role uses ephemeral users
+func (b *proxmoxBackend) createToken(ctx context.Context, req *logical.Request, role *proxmoxRoleEntry, user string, tokenID string, expire int64) (*proxmoxToken, error) {
+	client, err := b.getClient(ctx, req.Storage, role.connection())
 	if err != nil {
 		return nil, err
 	}
 
+	comment, err := renderTokenComment(role.CommentTemplate, tokenCommentTemplateData{
+		EntityID:      req.EntityID,
+		DisplayName:   req.DisplayName,
+		RequestID:     req.ID,
+		RoleName:      role.Name,
+		MountAccessor: req.MountAccessor,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error generating token comment for role '%v': %w", role.Name, err)
+	}
+
 	var token *proxmoxToken
 
-	expire := int64(0)
-	if role.TTL > 0 {
-		expire = time.Now().Add(role.TTL).Unix()
+	if role.EphemeralUser {
+		if err := client.CreateUser(ctx, user, role.Realm, "", role.Groups, expire); err != nil {
+			return nil, fmt.Errorf("error creating Proxmox user for role '%v': %w", role.Name, err)
+		}
 	}
 
-	// TODO: separated privileges always false for now, should support setting what privileges to use before exposing?
-	privsep := false
-
-	token, err = createToken(ctx, client, role.User, role.Realm, expire, privsep)
+	token, err = client.CreateToken(ctx, user, role.Realm, tokenID, comment, expire, role.SeparatedPrivileges)
+	if err == nil && token == nil {
+		err = errors.New("no token returned")
+	}
 	if err != nil {
+		if role.EphemeralUser {
+			if delErr := client.DeleteUser(ctx, user, role.Realm); delErr != nil {
+				b.Logger().Error("error deleting Proxmox user after failing to create API token", "role", role.Name, "user", user, "error", delErr)
+			}
+		}
 		return nil, fmt.Errorf("error creating Proxmox API token for role '%v': %w", role.Name, err)
 	}
+	token.EphemeralUser = role.EphemeralUser
 
-	if token == nil {
-		return nil, errors.New("error creating Proxmox API token")
+	if err := b.grantTokenPrivileges(ctx, client, role, token); err != nil {
+		if delErr := b.revokeToken(ctx, client, token, false); delErr != nil {
+			b.Logger().Error("error revoking Proxmox API token after failing to grant privileges", "role", role.Name, "error", delErr)
+		}
+		return nil, err
 	}
 
 	return token, nil
 }
 
+func (b *proxmoxBackend) grantTokenPrivileges(ctx context.Context, client proxmoxClient, role *proxmoxRoleEntry, token *proxmoxToken) error {
+	if len(role.ACLs) > 0 {
+		if err := client.SetTokenACLs(ctx, token.User, token.Realm, token.TokenID, role.ACLs); err != nil {
+			return fmt.Errorf("error setting ACLs on Proxmox API token for role '%v': %w", role.Name, err)
+		}
+	}
+
+	if len(role.Privileges) > 0 {
+		roleID := privilegeRoleID(token.TokenID)
+		if err := client.CreateRole(ctx, roleID, role.Privileges); err != nil {
+			return fmt.Errorf("error creating Proxmox role for role '%v': %w", role.Name, err)
+		}
+		token.PrivilegeRole = roleID
+
+		acl := proxmoxACLEntry{
+			Path:      role.PrivilegesPath,
+			Role:      roleID,
+			Propagate: true,
+		}
+		if err := client.SetTokenACLs(ctx, token.User, token.Realm, token.TokenID, []proxmoxACLEntry{acl}); err != nil {
+			return fmt.Errorf("error binding Proxmox role to API token for role '%v': %w", role.Name, err)
+		}
+	}
+
+	return nil
+}
+
 func (b *proxmoxBackend) createUserCreds(ctx context.Context, req *logical.Request, role *proxmoxRoleEntry) (*logical.Response, error) {
-	token, err := b.createToken(ctx, req.Storage, role)
-	if err != nil {
-		return nil, err
+	user := role.User
+	if role.EphemeralUser {
+		user = ephemeralUserName(role.Name)
+	}
+
+	var token *proxmoxToken
+	var walID string
+
+	for attempt := 1; ; attempt++ {
+		tokenID, err := renderTokenID(role.TokenIDTemplate, role.Name, req.DisplayName)
+		if err != nil {
+			return nil, fmt.Errorf("error generating token ID for role '%v': %w", role.Name, err)
+		}
+
+		token, walID, err = b.issueToken(ctx, req, role, user, tokenID)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, errTokenExists) || attempt == maxTokenIDAttempts {
+			return nil, err
+		}
+
+		b.Logger().Debug("token ID already taken, retrying", "role", role.Name, "token_id", tokenID)
 	}
 
-	tokenIDFull := fmt.Sprintf("%s@%s!%s", role.User, role.Realm, token.TokenID)
+	tokenIDFull := fmt.Sprintf("%s@%s!%s", token.User, token.Realm, token.TokenID)
 
-	resp := b.Secret(proxmoxTokenType).Response(map[string]interface{}{
+	data := map[string]interface{}{
 		"token_id":      token.TokenID,
 		"token_id_full": tokenIDFull,
 		"secret":        token.Secret,
-	}, map[string]interface{}{
-		"token_id": token.TokenID,
-		"role":     role.Name,
+	}
+
+	if token.EphemeralUser {
+		data["user"] = token.User
+		data["realm"] = token.Realm
+	}
+
+	resp := b.Secret(proxmoxTokenType).Response(data, map[string]interface{}{
+		"token_id":       token.TokenID,
+		"role":           role.Name,
+		"privilege_role": token.PrivilegeRole,
+		"ephemeral_user": token.EphemeralUser,
+		"user":           token.User,
+		"realm":          token.Realm,
+		"user_id":        formatUserID(token.User, token.Realm),
+		"connection":     role.connection(),
+		"indexed":        true,
 	})
 
 	if role.TTL > 0 {
@@ -82,6 +166,168 @@ func (b *proxmoxBackend) createUserCreds(ctx context.Context, req *logical.Reque
 		resp.Secret.MaxTTL = role.MaxTTL
 	}
 
+	if err := framework.DeleteWAL(ctx, req.Storage, walID); err != nil {
+		return nil, fmt.Errorf("error deleting WAL entry: %w", err)
+	}
+
+	return resp, nil
+}
+
+// issueToken creates a token for a lease, tracked by a WAL entry and the token index from before it exists.
+// If the token ID is already taken nothing is left behind and errTokenExists is returned.
+func (b *proxmoxBackend) issueToken(ctx context.Context, req *logical.Request, role *proxmoxRoleEntry, user string, tokenID string) (*proxmoxToken, string, error) {
+	existing, err := getTokenIndexEntry(ctx, req.Storage, tokenID)
+	if err != nil {
+		return nil, "", err
+	}
+	if existing != nil {
+		return nil, "", errTokenExists
+	}
+
+	entry := &walToken{
+		Connection:    role.connection(),
+		User:          user,
+		Realm:         role.Realm,
+		TokenID:       tokenID,
+		EphemeralUser: role.EphemeralUser,
+	}
+	if len(role.Privileges) > 0 {
+		entry.PrivilegeRole = privilegeRoleID(entry.TokenID)
+	}
+
+	// if the lease is never handed out the token would be left behind, the WAL entry lets it be rolled back
+	walID, err := framework.PutWAL(ctx, req.Storage, walTypeToken, entry)
+	if err != nil {
+		return nil, "", fmt.Errorf("error writing WAL entry: %w", err)
+	}
+
+	now := time.Now()
+
+	// the lease gets the TTL of the role, or of the mount if the role has none
+	ttl, _, err := framework.CalculateTTL(b.System(), 0, role.TTL, 0, role.MaxTTL, 0, now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	expire, err := tokenExpire(ctx, req.Storage, role.connection(), now, ttl)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// the token is indexed before it exists, tidy reads the index after listing tokens so it never sees
+	// the token without an entry
+	err = putTokenIndexEntry(ctx, req.Storage, &tokenIndexEntry{
+		TokenID:    entry.TokenID,
+		User:       user,
+		Realm:      role.Realm,
+		Connection: role.connection(),
+		Role:       role.Name,
+		EntityID:   req.EntityID,
+		CreatedAt:  now,
+		Expire:     expire,
+
+		EphemeralUser: role.EphemeralUser,
+		PrivilegeRole: entry.PrivilegeRole,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	token, err := b.createToken(ctx, req, role, user, entry.TokenID, expire)
+	if err != nil {
+		// the token isn't handed out, whatever may be left of it in Proxmox is up to the WAL entry
+		if delErr := deleteTokenIndexEntry(ctx, req.Storage, entry.TokenID); delErr != nil {
+			return nil, "", delErr
+		}
+
+		if errors.Is(err, errTokenExists) {
+			// the ID belongs to a token Vault doesn't know about, there is nothing to roll back
+			if delErr := framework.DeleteWAL(ctx, req.Storage, walID); delErr != nil {
+				return nil, "", delErr
+			}
+		}
+
+		return nil, "", err
+	}
+
+	return token, walID, nil
+}
+
+func (b *proxmoxBackend) createTicketCreds(ctx context.Context, req *logical.Request, role *proxmoxRoleEntry) (*logical.Response, error) {
+	client, err := b.getClient(ctx, req.Storage, role.connection())
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := generatePassword()
+	if err != nil {
+		return nil, err
+	}
+
+	user := role.User
+	var walID string
+	if role.EphemeralUser {
+		user = ephemeralUserName(role.Name)
+
+		// if the lease is never handed out the user would be left behind, the WAL entry lets it be rolled back
+		walID, err = framework.PutWAL(ctx, req.Storage, walTypeUser, &walUser{
+			Connection: role.connection(),
+			User:       user,
+			Realm:      role.Realm,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error writing WAL entry: %w", err)
+		}
+
+		expire := time.Now().Add(ticketLifetime).Unix()
+		if err := client.CreateUser(ctx, user, role.Realm, password, role.Groups, expire); err != nil {
+			return nil, fmt.Errorf("error creating Proxmox user for role '%v': %w", role.Name, err)
+		}
+	} else {
+		if err := client.SetUserPassword(ctx, user, role.Realm, password); err != nil {
+			return nil, fmt.Errorf("error setting Proxmox user password for role '%v': %w", role.Name, err)
+		}
+	}
+
+	issued := time.Now()
+	ticket, err := client.CreateTicket(ctx, user, role.Realm, password)
+	if err != nil {
+		if role.EphemeralUser {
+			if delErr := client.DeleteUser(ctx, user, role.Realm); delErr != nil {
+				b.Logger().Error("error deleting Proxmox user after failing to create ticket", "role", role.Name, "user", user, "error", delErr)
+			}
+		}
+		return nil, fmt.Errorf("error creating Proxmox ticket for role '%v': %w", role.Name, err)
+	}
+
+	resp := b.Secret(proxmoxTicketType).Response(map[string]interface{}{
+		"username":              ticket.Username,
+		"ticket":                ticket.Ticket,
+		"csrf_prevention_token": ticket.CSRFPreventionToken,
+		"expires_at":            issued.Add(ticketLifetime).Format(time.RFC3339),
+	}, map[string]interface{}{
+		"role":           role.Name,
+		"user":           user,
+		"realm":          role.Realm,
+		"user_id":        formatUserID(user, role.Realm),
+		"ephemeral_user": role.EphemeralUser,
+		"connection":     role.connection(),
+	})
+
+	// tickets can't be extended past their lifetime in Proxmox so the lease can't either
+	resp.Secret.TTL = ticketLifetime
+	if role.TTL > 0 && role.TTL < ticketLifetime {
+		resp.Secret.TTL = role.TTL
+	}
+	resp.Secret.MaxTTL = ticketLifetime
+	resp.Secret.Renewable = false
+
+	if walID != "" {
+		if err := framework.DeleteWAL(ctx, req.Storage, walID); err != nil {
+			return nil, fmt.Errorf("error deleting WAL entry: %w", err)
+		}
+	}
+
 	return resp, nil
 }
 
@@ -97,13 +343,18 @@ func (b *proxmoxBackend) pathCredentialsRead(ctx context.Context, req *logical.R
 		return nil, errors.New("error retrieving role: role is nil")
 	}
 
+	if roleEntry.CredentialType == credentialTypeTicket {
+		return b.createTicketCreds(ctx, req, roleEntry)
+	}
+
 	return b.createUserCreds(ctx, req, roleEntry)
 }
 
 const pathCredentialsHelpSyn = `
-Generate a Proxmox API token from a specific Vault role.
+Generate a Proxmox API token or auth ticket from a specific Vault role.
 `
 
 const pathCredentialsHelpDesc = `
-This path generates a Proxmox API token based on a particular role.
+This path generates a Proxmox API token based on a particular role, or an auth
+ticket with a CSRF prevention token for roles with credential_type "ticket".
 `
@@ -0,0 +1,366 @@
+package proxmox
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentials(t *testing.T) {
+	b, s, fake := getTestBackend(t)
+
+	roleUserID := formatUserID(testUser, testRealm)
+	fake.addUser(roleUserID)
+	testFakeConnection(t, b, s, defaultConnectionName, fake)
+
+	t.Run("Token", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":             testUser,
+			"realm":            testRealm,
+			"ttl":              "1h",
+			"comment_template": "entity {{ .EntityID }}",
+		})
+		require.Nil(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testCredsRead(t, b, s, roleName)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		tokenID := resp.Data["token_id"].(string)
+		require.Equal(t, roleUserID+"!"+tokenID, resp.Data["token_id_full"])
+
+		token := fake.token(roleUserID, tokenID)
+		require.NotNil(t, token)
+		require.Equal(t, token.Secret, resp.Data["secret"])
+		require.Equal(t, vaultComment+": entity test-entity", token.Comment)
+		require.InDelta(t, time.Now().Add(time.Hour+defaultTokenExpiryGrace).Unix(), token.Expire, 5)
+		require.False(t, token.Privsep)
+
+		entry, err := getTokenIndexEntry(context.Background(), s, tokenID)
+		require.NoError(t, err)
+		require.NotNil(t, entry)
+		require.Equal(t, token.Expire, entry.Expire)
+
+		walIDs, err := framework.ListWAL(context.Background(), s)
+		require.NoError(t, err)
+		require.Empty(t, walIDs)
+
+		_, err = testCredsRevoke(t, b, s, resp.Secret)
+		require.NoError(t, err)
+
+		require.Nil(t, fake.token(roleUserID, tokenID))
+
+		entry, err = getTokenIndexEntry(context.Background(), s, tokenID)
+		require.NoError(t, err)
+		require.Nil(t, entry)
+	})
+
+	t.Run("Token With Privileges", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, "privileges", map[string]interface{}{
+			"user":                 testUser,
+			"realm":                testRealm,
+			"separated_privileges": true,
+			"acls": []interface{}{
+				map[string]interface{}{"path": "/vms/100", "role": "PVEVMUser"},
+			},
+			"privileges":      "VM.Audit",
+			"privileges_path": "/vms",
+		})
+		require.Nil(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testCredsRead(t, b, s, "privileges")
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		tokenID := resp.Data["token_id"].(string)
+		require.True(t, fake.token(roleUserID, tokenID).Privsep)
+		require.True(t, fake.hasRole(privilegeRoleID(tokenID)))
+
+		acls := fake.tokenACLs(roleUserID + "!" + tokenID)
+		require.ElementsMatch(t, []fakeACL{
+			{Path: "/vms/100", Type: "token", UGID: roleUserID + "!" + tokenID, RoleID: "PVEVMUser", Propagate: true},
+			{Path: "/vms", Type: "token", UGID: roleUserID + "!" + tokenID, RoleID: privilegeRoleID(tokenID), Propagate: true},
+		}, acls)
+
+		_, err = testCredsRevoke(t, b, s, resp.Secret)
+		require.NoError(t, err)
+
+		require.Nil(t, fake.token(roleUserID, tokenID))
+		require.False(t, fake.hasRole(privilegeRoleID(tokenID)))
+		require.Empty(t, fake.tokenACLs(roleUserID+"!"+tokenID))
+	})
+
+	t.Run("Ephemeral User", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, "ephemeral", map[string]interface{}{
+			"realm":          testRealm,
+			"ephemeral_user": true,
+			"groups":         "ci",
+			"ttl":            "30m",
+		})
+		require.Nil(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testCredsRead(t, b, s, "ephemeral")
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		ephemeralUserID := formatUserID(resp.Data["user"].(string), testRealm)
+		require.True(t, strings.HasPrefix(ephemeralUserID, ephemeralUserPrefix))
+
+		ephemeralUser := fake.user(ephemeralUserID)
+		require.NotNil(t, ephemeralUser)
+		require.Equal(t, []string{"ci"}, ephemeralUser.Groups)
+		require.Equal(t, vaultComment, ephemeralUser.Comment)
+		require.Equal(t, fake.token(ephemeralUserID, resp.Data["token_id"].(string)).Expire, ephemeralUser.Expire)
+
+		_, err = testCredsRevoke(t, b, s, resp.Secret)
+		require.NoError(t, err)
+
+		require.Nil(t, fake.user(ephemeralUserID))
+	})
+
+	t.Run("Ticket", func(t *testing.T) {
+		ticketUserID := formatUserID("console", "pve")
+		fake.addUser(ticketUserID)
+
+		resp, err := testTokenRoleCreate(t, b, s, "ticket", map[string]interface{}{
+			"user":            "console",
+			"realm":           "pve",
+			"credential_type": "ticket",
+		})
+		require.Nil(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testCredsRead(t, b, s, "ticket")
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, ticketUserID, resp.Data["username"])
+		require.NotEmpty(t, resp.Data["ticket"])
+
+		password := fake.user(ticketUserID).Password
+		require.NotEmpty(t, password)
+
+		_, err = testCredsRevoke(t, b, s, resp.Secret)
+		require.NoError(t, err)
+
+		require.NotEqual(t, password, fake.user(ticketUserID).Password)
+	})
+
+	t.Run("Privilege Role Already Deleted In Proxmox", func(t *testing.T) {
+		resp, err := testCredsRead(t, b, s, "privileges")
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		tokenID := resp.Data["token_id"].(string)
+		client, err := b.getClient(context.Background(), s, defaultConnectionName)
+		require.NoError(t, err)
+		require.NoError(t, client.DeleteRole(context.Background(), privilegeRoleID(tokenID)))
+
+		_, err = testCredsRevoke(t, b, s, resp.Secret)
+		require.NoError(t, err)
+
+		require.Nil(t, fake.token(roleUserID, tokenID))
+	})
+
+	t.Run("Transient Failure Is Retried", func(t *testing.T) {
+		fake.inject(fakeFault{
+			Method: http.MethodPost,
+			Path:   "/access/users/" + roleUserID + "/token/",
+			Status: http.StatusInternalServerError,
+			Reason: "cfs-lock 'file-user_cfg' error: got lock request timeout",
+			Times:  1,
+		})
+
+		resp, err := testCredsRead(t, b, s, roleName)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		tokenID := resp.Data["token_id"].(string)
+		require.NotNil(t, fake.token(roleUserID, tokenID))
+
+		fake.inject(fakeFault{
+			Method: http.MethodDelete,
+			Path:   "/access/users/" + roleUserID + "/token/" + tokenID,
+			Status: http.StatusServiceUnavailable,
+			Reason: "Service Unavailable",
+			Times:  1,
+		})
+
+		_, err = testCredsRevoke(t, b, s, resp.Secret)
+		require.NoError(t, err)
+
+		require.Nil(t, fake.token(roleUserID, tokenID))
+	})
+
+	t.Run("Token Already Deleted In Proxmox", func(t *testing.T) {
+		resp, err := testCredsRead(t, b, s, roleName)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		tokenID := resp.Data["token_id"].(string)
+		fake.removeToken(roleUserID, tokenID)
+
+		_, err = testCredsRevoke(t, b, s, resp.Secret)
+		require.NoError(t, err)
+
+		entry, err := getTokenIndexEntry(context.Background(), s, tokenID)
+		require.NoError(t, err)
+		require.Nil(t, entry)
+	})
+
+	t.Run("Failed Token Is Rolled Back", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, "failing", map[string]interface{}{
+			"user":                 testUser,
+			"realm":                testRealm,
+			"separated_privileges": true,
+			"privileges":           "VM.Audit",
+		})
+		require.Nil(t, err)
+		require.Nil(t, resp)
+
+		fake.inject(fakeFault{
+			Method: http.MethodPost,
+			Path:   "/access/roles",
+			Status: http.StatusBadRequest,
+			Reason: "Parameter verification failed.",
+			Times:  1,
+		})
+
+		_, err = testCredsRead(t, b, s, "failing")
+		require.Error(t, err)
+
+		// the token and its index entry are deleted again right away, the WAL entry covers everything else
+		walIDs, err := framework.ListWAL(context.Background(), s)
+		require.NoError(t, err)
+		require.Len(t, walIDs, 1)
+
+		entry, err := framework.GetWAL(context.Background(), s, walIDs[0])
+		require.NoError(t, err)
+		tokenID := entry.Data.(map[string]interface{})["token_id"].(string)
+		require.Nil(t, fake.token(roleUserID, tokenID))
+
+		indexEntry, err := getTokenIndexEntry(context.Background(), s, tokenID)
+		require.NoError(t, err)
+		require.Nil(t, indexEntry)
+
+		tokenIDs, err := listRoleTokens(context.Background(), s, "failing")
+		require.NoError(t, err)
+		require.Empty(t, tokenIDs)
+
+		require.NoError(t, b.walRollback(context.Background(), &logical.Request{Storage: s}, entry.Kind, entry.Data))
+	})
+}
+
+func TestCredentialsVerifyRevocation(t *testing.T) {
+	b, s, fake := getTestBackend(t)
+
+	roleUserID := formatUserID(testUser, testRealm)
+	fake.addUser(roleUserID)
+	testFakeConnection(t, b, s, defaultConnectionName, fake)
+
+	err := testConfigUpdate(t, b, s, map[string]interface{}{
+		"verify_revocation": true,
+	})
+	require.NoError(t, err)
+
+	resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"user":  testUser,
+		"realm": testRealm,
+	})
+	require.Nil(t, err)
+	require.Nil(t, resp)
+
+	resp, err = testCredsRead(t, b, s, roleName)
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	tokenID := resp.Data["token_id"].(string)
+
+	// Proxmox claims to have deleted the token but didn't
+	fake.inject(fakeFault{
+		Method: http.MethodDelete,
+		Path:   "/access/users/" + roleUserID + "/token/" + tokenID,
+		Status: http.StatusOK,
+		Reason: "OK",
+		Times:  1,
+	})
+
+	_, err = testCredsRevoke(t, b, s, resp.Secret)
+	require.ErrorContains(t, err, "still exists")
+
+	entry, err := getTokenIndexEntry(context.Background(), s, tokenID)
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+
+	_, err = testCredsRevoke(t, b, s, resp.Secret)
+	require.NoError(t, err)
+	require.Nil(t, fake.token(roleUserID, tokenID))
+}
+
+// recordingClient records the tokens created through a client
+type recordingClient struct {
+	proxmoxClient
+	created []string
+}
+
+func (c *recordingClient) CreateToken(ctx context.Context, user string, realm string, tokenID string, comment string, expire int64, privsep bool) (*proxmoxToken, error) {
+	c.created = append(c.created, formatUserID(user, realm)+"!"+tokenID)
+	return c.proxmoxClient.CreateToken(ctx, user, realm, tokenID, comment, expire, privsep)
+}
+
+func TestCredentialsClient(t *testing.T) {
+	b, s, fake := getTestBackend(t)
+
+	recorder := &recordingClient{}
+	b.newClient = func(config *proxmoxConfig) (proxmoxClient, error) {
+		client, err := newClient(config)
+		recorder.proxmoxClient = client
+		return recorder, err
+	}
+
+	fake.addUser(formatUserID(testUser, testRealm))
+	testFakeConnection(t, b, s, defaultConnectionName, fake)
+
+	resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"user":  testUser,
+		"realm": testRealm,
+	})
+	require.Nil(t, err)
+	require.Nil(t, resp)
+
+	resp, err = testCredsRead(t, b, s, roleName)
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	require.Equal(t, []string{resp.Data["token_id_full"].(string)}, recorder.created)
+}
+
+// testCredsRead reads credentials of a role the way a Vault client with an entity would
+func testCredsRead(t *testing.T, b *proxmoxBackend, s logical.Storage, name string) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation:   logical.ReadOperation,
+		Path:        "creds/" + name,
+		Storage:     s,
+		EntityID:    "test-entity",
+		DisplayName: "token",
+	})
+}
+
+// testCredsRevoke revokes the lease of credentials
+func testCredsRevoke(t *testing.T, b *proxmoxBackend, s logical.Storage, secret *logical.Secret) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Storage:   s,
+		Secret:    secret,
+	})
+}
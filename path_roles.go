@@ -2,21 +2,41 @@ package proxmox
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
-type proxmoxRoleEntry struct {
-	Name   string        `json:"name"`
-	User   string        `json:"user"`
-	Realm  string        `json:"realm"`
-	TTL    time.Duration `json:"ttl"`
-	MaxTTL time.Duration `json:"max_ttl"`
+const (
+	credentialTypeAPIToken = "api_token"
+	credentialTypeTicket   = "ticket"
+)
 
-	//SeparatedPrivileges bool          `json:"separated_privileges"`
+// proxmoxRoleEntry is a role issuing credentials for leases. Options added over time are read through
+// accessors, which give roles stored before an option existed its default.
+type proxmoxRoleEntry struct {
+	Name           string        `json:"name"`
+	User           string        `json:"user"`
+	Realm          string        `json:"realm"`
+	TTL            time.Duration `json:"ttl"`
+	MaxTTL         time.Duration `json:"max_ttl"`
+	CredentialType string        `json:"credential_type"`
+	Connection     string        `json:"connection"`
+
+	TokenIDTemplate string `json:"token_id_template"`
+	CommentTemplate string `json:"comment_template"`
+
+	SeparatedPrivileges bool              `json:"separated_privileges"`
+	ACLs                []proxmoxACLEntry `json:"acls"`
+	Privileges          []string          `json:"privileges"`
+	PrivilegesPath      string            `json:"privileges_path"`
+
+	EphemeralUser bool     `json:"ephemeral_user"`
+	Groups        []string `json:"groups"`
 }
 
 func (r *proxmoxRoleEntry) toResponseData() map[string]interface{} {
@@ -27,11 +47,39 @@ func (r *proxmoxRoleEntry) toResponseData() map[string]interface{} {
 		"ttl":     r.TTL.Seconds(),
 		"max_ttl": r.MaxTTL.Seconds(),
 
-		//"separated_privileges": r.SeparatedPrivileges,
+		"credential_type": r.credentialType(),
+		"connection":      r.connection(),
+
+		"token_id_template": r.TokenIDTemplate,
+		"comment_template":  r.CommentTemplate,
+
+		"separated_privileges": r.SeparatedPrivileges,
+		"acls":                 aclEntriesToResponseData(r.ACLs),
+		"privileges":           r.Privileges,
+		"privileges_path":      r.PrivilegesPath,
+
+		"ephemeral_user": r.EphemeralUser,
+		"groups":         r.Groups,
 	}
 	return respData
 }
 
+// credentialType returns the type of credentials issued
+func (r *proxmoxRoleEntry) credentialType() string {
+	if r.CredentialType == "" {
+		return credentialTypeAPIToken
+	}
+	return r.CredentialType
+}
+
+// connection returns the name of the connection the role issues credentials on
+func (r *proxmoxRoleEntry) connection() string {
+	if r.Connection == "" {
+		return defaultConnectionName
+	}
+	return r.Connection
+}
+
 func pathRole(b *proxmoxBackend) []*framework.Path {
 	return []*framework.Path{
 		{
@@ -44,14 +92,22 @@ func pathRole(b *proxmoxBackend) []*framework.Path {
 				},
 				"user": {
 					Type:        framework.TypeString,
-					Description: "User in Proxmox this role will impersonate",
-					Required:    true,
+					Description: "User in Proxmox this role will impersonate, not used with ephemeral_user",
 				},
 				"realm": {
 					Type:        framework.TypeString,
 					Description: "Realm of the user in Proxmox, e.g. pam",
 					Required:    true,
 				},
+				"ephemeral_user": {
+					Type:        framework.TypeBool,
+					Description: "Create a new user with a generated name in realm for every lease, deleted again on revocation",
+					Default:     false,
+				},
+				"groups": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Groups ephemeral users are made members of",
+				},
 				"ttl": {
 					Type:        framework.TypeDurationSecond,
 					Description: "Default lease for generated credentials. If not set or set to 0, will use system default.",
@@ -60,6 +116,47 @@ func pathRole(b *proxmoxBackend) []*framework.Path {
 					Type:        framework.TypeDurationSecond,
 					Description: "Maximum time for role. If not set or set to 0, will use system default.",
 				},
+				"credential_type": {
+					Type:        framework.TypeString,
+					Description: "Type of credentials issued, either api_token or ticket. Tickets require a user in the pve realm, either ephemeral or one whose password Vault may change.",
+					Default:     credentialTypeAPIToken,
+				},
+				"connection": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the connection configured at config/<name> to issue credentials on",
+					Default:     defaultConnectionName,
+				},
+				"separated_privileges": {
+					Type:        framework.TypeBool,
+					Description: "Create tokens with separated privileges, limited to the ACLs given in acls instead of inheriting all privileges of the user",
+					Default:     false,
+				},
+				"acls": {
+					Type:        framework.TypeSlice,
+					Description: "List of ACL entries applied to each token, as objects with path, role and optional propagate (default true). Requires separated_privileges.",
+				},
+				"privileges": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Proxmox privileges, e.g. VM.Allocate, granted to each token through a temporary Proxmox role that is deleted on revocation. Requires separated_privileges.",
+				},
+				"privileges_path": {
+					Type:        framework.TypeString,
+					Description: "Path the temporary Proxmox role holding privileges is granted on, including everything below it",
+					Default:     "/",
+				},
+				"token_id_template": {
+					Type:        framework.TypeString,
+					Description: "Template for the IDs of new tokens, e.g. {{ .RoleName }}-{{ unix_time }}-{{ random 6 }}. .RoleName and .DisplayName are available, characters not allowed in token IDs are replaced with '-' in .DisplayName. If not set, IDs are random.",
+				},
+				"comment_template": {
+					Type:        framework.TypeString,
+					Description: "Template for the comment of new tokens, added after \"Managed by Vault\", e.g. entity {{ .EntityID }} ({{ .DisplayName }}). .EntityID, .DisplayName, .RequestID, .RoleName and .MountAccessor are available.",
+				},
+				"force": {
+					Type:        framework.TypeBool,
+					Description: "On delete, delete all tokens still issued for the role in Proxmox first instead of refusing",
+					Default:     false,
+				},
 			},
 			Operations: map[logical.Operation]framework.OperationHandler{
 				logical.ReadOperation: &framework.PathOperation{
@@ -165,14 +262,37 @@ func (b *proxmoxBackend) pathRolesWrite(ctx context.Context, req *logical.Reques
 
 	createOperation := (req.Operation == logical.CreateOperation)
 
+	if ephemeralUser, ok := d.GetOk("ephemeral_user"); ok {
+		roleEntry.EphemeralUser = ephemeralUser.(bool)
+	} else if createOperation {
+		roleEntry.EphemeralUser = d.Get("ephemeral_user").(bool)
+	}
+
+	if groups, ok := d.GetOk("groups"); ok {
+		roleEntry.Groups = groups.([]string)
+	}
+
 	user, ok := d.GetOk("user")
 	ok = ok && len(user.(string)) > 0
 	if ok {
+		if roleEntry.EphemeralUser {
+			return logical.ErrorResponse("user cannot be set when ephemeral_user is enabled"), nil
+		}
 		roleEntry.User = user.(string)
-	} else if !ok && createOperation {
+	} else if !ok && createOperation && !roleEntry.EphemeralUser {
 		return nil, fmt.Errorf("missing user in role")
 	}
 
+	if roleEntry.EphemeralUser {
+		roleEntry.User = ""
+	} else if len(roleEntry.User) == 0 {
+		return nil, fmt.Errorf("missing user in role")
+	}
+
+	if len(roleEntry.Groups) > 0 && !roleEntry.EphemeralUser {
+		return logical.ErrorResponse("groups can only be set when ephemeral_user is enabled"), nil
+	}
+
 	realm, ok := d.GetOk("realm")
 	ok = ok && len(realm.(string)) > 0
 	if ok {
@@ -181,6 +301,32 @@ func (b *proxmoxBackend) pathRolesWrite(ctx context.Context, req *logical.Reques
 		return nil, fmt.Errorf("missing realm in role")
 	}
 
+	if credentialType, ok := d.GetOk("credential_type"); ok {
+		roleEntry.CredentialType = credentialType.(string)
+	} else if createOperation {
+		roleEntry.CredentialType = d.Get("credential_type").(string)
+	}
+
+	switch roleEntry.credentialType() {
+	case credentialTypeAPIToken:
+	case credentialTypeTicket:
+		if roleEntry.Realm != "pve" {
+			return logical.ErrorResponse("credential_type ticket requires a user in the pve realm"), nil
+		}
+	default:
+		return logical.ErrorResponse("invalid credential_type %q, must be %s or %s", roleEntry.CredentialType, credentialTypeAPIToken, credentialTypeTicket), nil
+	}
+
+	if connection, ok := d.GetOk("connection"); ok {
+		roleEntry.Connection = connection.(string)
+	} else if createOperation {
+		roleEntry.Connection = d.Get("connection").(string)
+	}
+
+	if resp, err := validateConnection(ctx, req.Storage, roleEntry.connection()); resp != nil || err != nil {
+		return resp, err
+	}
+
 	if ttlRaw, ok := d.GetOk("ttl"); ok {
 		roleEntry.TTL = time.Duration(ttlRaw.(int)) * time.Second
 	} else if createOperation {
@@ -197,15 +343,205 @@ func (b *proxmoxBackend) pathRolesWrite(ctx context.Context, req *logical.Reques
 		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
 	}
 
+	if separatedPrivileges, ok := d.GetOk("separated_privileges"); ok {
+		roleEntry.SeparatedPrivileges = separatedPrivileges.(bool)
+	} else if createOperation {
+		roleEntry.SeparatedPrivileges = d.Get("separated_privileges").(bool)
+	}
+
+	if aclsRaw, ok := d.GetOk("acls"); ok {
+		acls, err := parseACLEntries(aclsRaw.([]interface{}))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		roleEntry.ACLs = acls
+	}
+
+	if privileges, ok := d.GetOk("privileges"); ok {
+		if err := validatePrivileges(privileges.([]string)); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		roleEntry.Privileges = privileges.([]string)
+	}
+
+	if privilegesPath, ok := d.GetOk("privileges_path"); ok {
+		roleEntry.PrivilegesPath = privilegesPath.(string)
+	} else if createOperation {
+		roleEntry.PrivilegesPath = d.Get("privileges_path").(string)
+	}
+
+	if !strings.HasPrefix(roleEntry.PrivilegesPath, "/") {
+		return logical.ErrorResponse("privileges_path must start with '/'"), nil
+	}
+
+	if tokenIDTemplate, ok := d.GetOk("token_id_template"); ok {
+		roleEntry.TokenIDTemplate = tokenIDTemplate.(string)
+	}
+
+	// the display name is only known when issuing, this checks the template with a typical one
+	tokenID, err := renderTokenID(roleEntry.TokenIDTemplate, roleEntry.Name, "token")
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	var warnings []string
+
+	// a template rendering the same ID again fails leases issued at the same time after maxTokenIDAttempts
+	if tokenIDAgain, err := renderTokenID(roleEntry.TokenIDTemplate, roleEntry.Name, "token"); err == nil && tokenIDAgain == tokenID {
+		warnings = append(warnings, "token_id_template rendered the same token ID twice, leases issued at the same time will collide unless it includes random characters")
+	}
+
+	if commentTemplate, ok := d.GetOk("comment_template"); ok {
+		roleEntry.CommentTemplate = commentTemplate.(string)
+	}
+
+	if _, err := renderTokenComment(roleEntry.CommentTemplate, tokenCommentTemplateData{
+		EntityID:      "00000000-0000-0000-0000-000000000000",
+		DisplayName:   "token",
+		RequestID:     "00000000-0000-0000-0000-000000000000",
+		RoleName:      roleEntry.Name,
+		MountAccessor: "proxmox_00000000",
+	}); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if len(roleEntry.ACLs) > 0 && !roleEntry.SeparatedPrivileges {
+		return logical.ErrorResponse("acls require separated_privileges to be enabled"), nil
+	}
+
+	if len(roleEntry.Privileges) > 0 && !roleEntry.SeparatedPrivileges {
+		return logical.ErrorResponse("privileges require separated_privileges to be enabled"), nil
+	}
+
+	if roleEntry.credentialType() == credentialTypeTicket && roleEntry.SeparatedPrivileges {
+		return logical.ErrorResponse("separated_privileges, acls and privileges only apply to credential_type api_token"), nil
+	}
+
+	targetWarnings, err := b.validateRoleTarget(ctx, req.Storage, roleEntry)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	warnings = append(warnings, targetWarnings...)
+
 	if err := setRole(ctx, req.Storage, name.(string), roleEntry); err != nil {
 		return nil, err
 	}
 
+	if len(warnings) > 0 {
+		return &logical.Response{Warnings: warnings}, nil
+	}
+
 	return nil, nil
 }
 
+// validateRoleTarget checks that the realm and user of a role exist in Proxmox and that the configured token
+// can issue its credentials, returning warnings for anything that will only break later and an error for
+// what can't work at all
+func (b *proxmoxBackend) validateRoleTarget(ctx context.Context, s logical.Storage, role *proxmoxRoleEntry) ([]string, error) {
+	config, err := getConfig(ctx, s, role.connection())
+	if err != nil {
+		return nil, err
+	}
+
+	// roles may be written before their connection is configured
+	if config == nil {
+		return nil, nil
+	}
+
+	client, err := b.getClient(ctx, s, role.connection())
+	if err != nil {
+		return nil, err
+	}
+
+	// an unreachable cluster shouldn't block managing roles
+	exists, err := client.RealmExists(ctx, role.Realm)
+	if err != nil {
+		return []string{fmt.Sprintf("realm and user were not checked: %s", err)}, nil
+	}
+
+	if !exists {
+		return nil, fmt.Errorf("realm %q does not exist in Proxmox", role.Realm)
+	}
+
+	missing, err := missingPrivileges(ctx, client, rolePrivileges(role))
+	if err != nil {
+		return []string{fmt.Sprintf("privileges of the configured token were not checked: %s", err)}, nil
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("token of connection %q is missing privileges needed by this role: %s", role.connection(), strings.Join(missing, ", "))
+	}
+
+	if role.EphemeralUser {
+		return nil, nil
+	}
+
+	user, err := client.GetUser(ctx, role.User, role.Realm)
+	if err != nil {
+		return []string{fmt.Sprintf("user was not checked: %s", err)}, nil
+	}
+
+	if user == nil {
+		return nil, fmt.Errorf("user %q does not exist in Proxmox", formatUserID(role.User, role.Realm))
+	}
+
+	var warnings []string
+
+	if !user.Enabled {
+		warnings = append(warnings, fmt.Sprintf("user %q is disabled in Proxmox", formatUserID(role.User, role.Realm)))
+	}
+
+	maxTTL := role.MaxTTL
+	if maxTTL == 0 {
+		maxTTL = b.System().MaxLeaseTTL()
+	}
+
+	if user.Expire > 0 {
+		expire := time.Unix(user.Expire, 0)
+		if expire.Before(time.Now().Add(maxTTL)) {
+			warnings = append(warnings, fmt.Sprintf("user %q expires in Proxmox at %s, before leases of this role reach their max_ttl", formatUserID(role.User, role.Realm), expire.UTC().Format(time.RFC3339)))
+		}
+	}
+
+	return warnings, nil
+}
+
 func (b *proxmoxBackend) pathRolesDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	err := req.Storage.Delete(ctx, "role/"+d.Get("name").(string))
+	name := d.Get("name").(string)
+
+	tokenIDs, err := listRoleTokens(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokenIDs) > 0 {
+		if !d.Get("force").(bool) {
+			return logical.ErrorResponse("role %q has %d active tokens, revoke their leases first or delete it with force=true", name, len(tokenIDs)), nil
+		}
+
+		var errs error
+		for _, tokenID := range tokenIDs {
+			entry, err := getTokenIndexEntry(ctx, req.Storage, tokenID)
+			if err != nil {
+				errs = errors.Join(errs, err)
+				continue
+			}
+			if entry == nil {
+				continue
+			}
+
+			if err := b.revokeIndexedToken(ctx, req.Storage, entry); err != nil {
+				errs = errors.Join(errs, err)
+			}
+		}
+
+		// the role is kept while any of its tokens is left so the delete can be retried
+		if errs != nil {
+			return nil, fmt.Errorf("error deleting tokens of role: %w", errs)
+		}
+	}
+
+	err = req.Storage.Delete(ctx, "role/"+name)
 	if err != nil {
 		return nil, fmt.Errorf("error deleting role: %w", err)
 	}
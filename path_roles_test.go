@@ -4,6 +4,7 @@ import (
 	"context"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/require"
@@ -18,7 +19,7 @@ const (
 )
 
 func TestUserRole(t *testing.T) {
-	b, s := getTestBackend(t)
+	b, s, _ := getTestBackend(t)
 
 	t.Run("List All Roles", func(t *testing.T) {
 		for i := 1; i <= 10; i++ {
@@ -59,6 +60,8 @@ func TestUserRole(t *testing.T) {
 		require.NotNil(t, resp)
 		require.Equal(t, user, resp.Data["user"])
 		require.Equal(t, realm, resp.Data["realm"])
+		require.Equal(t, "api_token", resp.Data["credential_type"])
+		require.Equal(t, defaultConnectionName, resp.Data["connection"])
 	})
 	t.Run("Update User Role", func(t *testing.T) {
 		resp, err := testTokenRoleUpdate(t, b, s, map[string]interface{}{
@@ -89,6 +92,540 @@ func TestUserRole(t *testing.T) {
 	})
 }
 
+func TestUserRoleACLs(t *testing.T) {
+	b, s, _ := getTestBackend(t)
+
+	t.Run("Create User Role with ACLs - fail without separated privileges", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":  user,
+			"realm": realm,
+			"acls": []interface{}{
+				map[string]interface{}{"path": "/vms/100", "role": "PVEVMUser"},
+			},
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create User Role with ACLs - fail on invalid path", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":                 user,
+			"realm":                realm,
+			"separated_privileges": true,
+			"acls": []interface{}{
+				map[string]interface{}{"path": "vms/100", "role": "PVEVMUser"},
+			},
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create User Role with ACLs - pass", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":                 user,
+			"realm":                realm,
+			"separated_privileges": true,
+			"acls": []interface{}{
+				map[string]interface{}{"path": "/vms/100", "role": "PVEVMUser"},
+				map[string]interface{}{"path": "/storage/local", "role": "PVEDatastoreUser", "propagate": false},
+			},
+		})
+
+		require.Nil(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("Read User Role with ACLs", func(t *testing.T) {
+		resp, err := testTokenRoleRead(t, b, s)
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, true, resp.Data["separated_privileges"])
+		require.Equal(t, []map[string]interface{}{
+			{"path": "/vms/100", "role": "PVEVMUser", "propagate": true},
+			{"path": "/storage/local", "role": "PVEDatastoreUser", "propagate": false},
+		}, resp.Data["acls"])
+	})
+}
+
+func TestUserRolePrivileges(t *testing.T) {
+	b, s, _ := getTestBackend(t)
+
+	t.Run("Create User Role with privileges - fail on invalid privilege", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":                 user,
+			"realm":                realm,
+			"separated_privileges": true,
+			"privileges":           "VM.Allocate,allocate everything",
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create User Role with privileges - pass", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":                 user,
+			"realm":                realm,
+			"separated_privileges": true,
+			"privileges":           "VM.Allocate,Datastore.AllocateSpace",
+		})
+
+		require.Nil(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("Read User Role with privileges", func(t *testing.T) {
+		resp, err := testTokenRoleRead(t, b, s)
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, []string{"VM.Allocate", "Datastore.AllocateSpace"}, resp.Data["privileges"])
+		require.Equal(t, "/", resp.Data["privileges_path"])
+	})
+}
+
+func TestEphemeralUserRole(t *testing.T) {
+	b, s, _ := getTestBackend(t)
+
+	t.Run("Create Ephemeral User Role - fail with user", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":           user,
+			"realm":          "pve",
+			"ephemeral_user": true,
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Ephemeral User Role - pass", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"realm":          "pve",
+			"ephemeral_user": true,
+			"groups":         "ci,builders",
+			"ttl":            testTTL,
+		})
+
+		require.Nil(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("Read Ephemeral User Role", func(t *testing.T) {
+		resp, err := testTokenRoleRead(t, b, s)
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, true, resp.Data["ephemeral_user"])
+		require.Equal(t, "", resp.Data["user"])
+		require.Equal(t, []string{"ci", "builders"}, resp.Data["groups"])
+	})
+
+	t.Run("Update Ephemeral User Role - fail without user", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/" + roleName,
+			Data: map[string]interface{}{
+				"ephemeral_user": false,
+			},
+			Storage: s,
+		})
+
+		require.Error(t, err)
+		require.Nil(t, resp)
+	})
+}
+
+func TestTicketRole(t *testing.T) {
+	b, s, _ := getTestBackend(t)
+
+	t.Run("Create Ticket Role - fail on invalid credential type", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":            testUser,
+			"realm":           "pve",
+			"credential_type": "password",
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Ticket Role - fail outside pve realm", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":            testUser,
+			"realm":           testRealm,
+			"credential_type": "ticket",
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Ticket Role - pass", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"realm":           "pve",
+			"ephemeral_user":  true,
+			"credential_type": "ticket",
+		})
+
+		require.Nil(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("Read Ticket Role", func(t *testing.T) {
+		resp, err := testTokenRoleRead(t, b, s)
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, "ticket", resp.Data["credential_type"])
+	})
+}
+
+func TestRoleConnection(t *testing.T) {
+	b, s, fake := getTestBackend(t)
+	fake.addUser(formatUserID(testUser, testRealm))
+
+	t.Run("Create Role - fail on unknown connection", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":       testUser,
+			"realm":      testRealm,
+			"connection": "other",
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Role - pass", func(t *testing.T) {
+		testFakeConnection(t, b, s, "other", fake)
+
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":       testUser,
+			"realm":      testRealm,
+			"connection": "other",
+		})
+
+		require.Nil(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("Read Role", func(t *testing.T) {
+		resp, err := testTokenRoleRead(t, b, s)
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, "other", resp.Data["connection"])
+	})
+}
+
+func TestRoleTokenIDTemplate(t *testing.T) {
+	b, s, _ := getTestBackend(t)
+
+	t.Run("Create Role - fail on invalid template", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":              testUser,
+			"realm":             testRealm,
+			"token_id_template": "{{ .RoleName",
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Role - fail on invalid token ID", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":              testUser,
+			"realm":             testRealm,
+			"token_id_template": "{{ unix_time }}-{{ .RoleName }}",
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Role - warn on constant token ID", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":              testUser,
+			"realm":             testRealm,
+			"token_id_template": "{{ .RoleName }}",
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.False(t, resp.IsError())
+		require.Len(t, resp.Warnings, 1)
+	})
+
+	t.Run("Create Role - pass", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":              testUser,
+			"realm":             testRealm,
+			"token_id_template": "{{ .RoleName }}-{{ unix_time }}-{{ random 6 }}",
+		})
+
+		require.Nil(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("Read Role", func(t *testing.T) {
+		resp, err := testTokenRoleRead(t, b, s)
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, "{{ .RoleName }}-{{ unix_time }}-{{ random 6 }}", resp.Data["token_id_template"])
+	})
+}
+
+func TestRoleCommentTemplate(t *testing.T) {
+	b, s, _ := getTestBackend(t)
+
+	t.Run("Create Role - fail on invalid template", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":             testUser,
+			"realm":            testRealm,
+			"comment_template": "{{ .EntityID",
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Role - fail on unknown field", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":             testUser,
+			"realm":            testRealm,
+			"comment_template": "{{ .LeaseID }}",
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Role - pass", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":             testUser,
+			"realm":            testRealm,
+			"comment_template": "entity {{ .EntityID }} ({{ .DisplayName }})",
+		})
+
+		require.Nil(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("Read Role", func(t *testing.T) {
+		resp, err := testTokenRoleRead(t, b, s)
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, "entity {{ .EntityID }} ({{ .DisplayName }})", resp.Data["comment_template"])
+	})
+}
+
+func TestRoleDeleteWithTokens(t *testing.T) {
+	b, s, fake := getTestBackend(t)
+
+	resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"user":  testUser,
+		"realm": testRealm,
+	})
+	require.Nil(t, err)
+	require.Nil(t, resp)
+
+	require.NoError(t, putTokenIndexEntry(context.Background(), s, &tokenIndexEntry{
+		TokenID:    "abc-def",
+		User:       testUser,
+		Realm:      testRealm,
+		Connection: defaultConnectionName,
+		Role:       roleName,
+	}))
+
+	t.Run("Delete Role - fail with active tokens", func(t *testing.T) {
+		resp, err := testTokenRoleDelete(t, b, s)
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Force Delete Role - keep role when tokens can't be deleted", func(t *testing.T) {
+		// nothing is configured, so deleting the token fails
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "role/" + roleName,
+			Data:      map[string]interface{}{"force": true},
+			Storage:   s,
+		})
+		require.Error(t, err)
+
+		resp, err := testTokenRoleRead(t, b, s)
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+	})
+
+	t.Run("Renew Without Role", func(t *testing.T) {
+		require.NoError(t, s.Delete(context.Background(), "role/"+roleName))
+
+		fake.addUser(formatUserID(testUser, testRealm))
+		fake.addToken(formatUserID(testUser, testRealm), "abc-def")
+		testFakeConnection(t, b, s, defaultConnectionName, fake)
+
+		resp, err := b.tokenRenew(context.Background(), &logical.Request{
+			Storage: s,
+			Secret: &logical.Secret{
+				InternalData: map[string]interface{}{
+					"token_id": "abc-def",
+					"role":     roleName,
+					"indexed":  true,
+				},
+			},
+		}, nil)
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+	})
+
+	t.Run("Revoke Already Removed Token", func(t *testing.T) {
+		require.NoError(t, deleteTokenIndexEntry(context.Background(), s, "abc-def"))
+
+		resp, err := b.tokenRevoke(context.Background(), &logical.Request{
+			Storage: s,
+			Secret: &logical.Secret{
+				InternalData: map[string]interface{}{
+					"token_id": "abc-def",
+					"role":     roleName,
+					"indexed":  true,
+				},
+			},
+		}, nil)
+
+		require.Nil(t, err)
+		require.Nil(t, resp)
+	})
+}
+
+func TestRoleTargetValidation(t *testing.T) {
+	b, s, fake := getTestBackend(t)
+
+	fake.addUser(formatUserID(testUser, testRealm))
+	fake.addUser(formatUserID("disabled", testRealm))
+	fake.setUserStatus(formatUserID("disabled", testRealm), false, 0)
+	fake.addUser(formatUserID("expiring", testRealm))
+	fake.setUserStatus(formatUserID("expiring", testRealm), true, time.Now().Add(time.Hour).Unix())
+
+	testFakeConnection(t, b, s, defaultConnectionName, fake)
+
+	t.Run("Create Role - fail on unknown realm", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":  testUser,
+			"realm": "ldap",
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Role - fail on unknown user", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":  "nobody",
+			"realm": testRealm,
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Role - warn on disabled user", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":  "disabled",
+			"realm": testRealm,
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.False(t, resp.IsError())
+		require.Len(t, resp.Warnings, 1)
+	})
+
+	t.Run("Create Role - warn on user expiring before max_ttl", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":    "expiring",
+			"realm":   testRealm,
+			"max_ttl": "24h",
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.False(t, resp.IsError())
+		require.Len(t, resp.Warnings, 1)
+	})
+
+	t.Run("Create Role - pass", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":    "expiring",
+			"realm":   testRealm,
+			"max_ttl": "30m",
+		})
+
+		require.Nil(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("Create Ephemeral Role - only check realm", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"realm":          testRealm,
+			"ephemeral_user": true,
+		})
+
+		require.Nil(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("Create Role - fail on privileges the token lacks", func(t *testing.T) {
+		fake.setPermissions("/access", "User.Modify")
+		fake.setPermissions("/", "Permissions.Modify")
+
+		resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":  testUser,
+			"realm": testRealm,
+		})
+		require.Nil(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"user":                 testUser,
+			"realm":                testRealm,
+			"separated_privileges": true,
+			"privileges":           "VM.Audit",
+		})
+		require.Nil(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), "Sys.Modify on path '/access'")
+
+		resp, err = testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+			"realm":          testRealm,
+			"ephemeral_user": true,
+		})
+		require.Nil(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), "Realm.AllocateUser on path '/access/realm/"+testRealm+"'")
+	})
+}
+
 // Utility function to create a role while, returning any response (including errors)
 func testTokenRoleCreate(t *testing.T, b *proxmoxBackend, s logical.Storage, name string, d map[string]interface{}) (*logical.Response, error) {
 	t.Helper()
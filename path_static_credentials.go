@@ -0,0 +1,75 @@
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathStaticCredentials(b *proxmoxBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "static-creds/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the static role",
+				Required:    true,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathStaticCredentialsRead,
+		},
+		HelpSynopsis:    pathStaticCredentialsHelpSyn,
+		HelpDescription: pathStaticCredentialsHelpDesc,
+	}
+}
+
+func (b *proxmoxBackend) pathStaticCredentialsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.staticRoleLock.RLock()
+	defer b.staticRoleLock.RUnlock()
+
+	roleEntry, err := b.getStaticRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving static role: %w", err)
+	}
+
+	if roleEntry == nil {
+		return logical.ErrorResponse("static role not found"), nil
+	}
+
+	if roleEntry.Secret == "" {
+		return logical.ErrorResponse("static role has no current token, rotate it to create one"), nil
+	}
+
+	data := map[string]interface{}{
+		"token_id":            roleEntry.TokenID,
+		"token_id_full":       fmt.Sprintf("%s@%s!%s", roleEntry.User, roleEntry.Realm, roleEntry.TokenID),
+		"secret":              roleEntry.Secret,
+		"last_vault_rotation": roleEntry.LastRotated,
+		"rotation_period":     roleEntry.RotationPeriod.Seconds(),
+	}
+
+	if next := roleEntry.nextRotation(); !next.IsZero() {
+		ttl := time.Until(next)
+		if ttl < 0 {
+			ttl = 0
+		}
+		data["ttl"] = ttl.Seconds()
+	}
+
+	return &logical.Response{
+		Data: data,
+	}, nil
+}
+
+const pathStaticCredentialsHelpSyn = `
+Read the current Proxmox API token of a static role.
+`
+
+const pathStaticCredentialsHelpDesc = `
+This path returns the current secret of the token managed by a static role. The
+token ID stays the same, the secret changes whenever the token is rotated.
+`
@@ -0,0 +1,505 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	staticRoleStoragePrefix = "static-role/"
+	minRotationPeriod       = 5 * time.Minute
+)
+
+var tokenIDRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9.\-_]+$`)
+
+type proxmoxStaticRoleEntry struct {
+	Name                string            `json:"name"`
+	User                string            `json:"user"`
+	Realm               string            `json:"realm"`
+	TokenID             string            `json:"token_id"`
+	RotationPeriod      time.Duration     `json:"rotation_period"`
+	SeparatedPrivileges bool              `json:"separated_privileges"`
+	ACLs                []proxmoxACLEntry `json:"acls"`
+	Connection          string            `json:"connection"`
+
+	Secret      string    `json:"secret"`
+	LastRotated time.Time `json:"last_rotated"`
+}
+
+func (r *proxmoxStaticRoleEntry) toResponseData() map[string]interface{} {
+	respData := map[string]interface{}{
+		"name":                 r.Name,
+		"user":                 r.User,
+		"realm":                r.Realm,
+		"token_id":             r.TokenID,
+		"rotation_period":      r.RotationPeriod.Seconds(),
+		"separated_privileges": r.SeparatedPrivileges,
+		"acls":                 aclEntriesToResponseData(r.ACLs),
+		"connection":           r.connection(),
+		"last_vault_rotation":  r.LastRotated,
+	}
+	return respData
+}
+
+// connection returns the name of the connection the token lives on
+func (r *proxmoxStaticRoleEntry) connection() string {
+	if r.Connection == "" {
+		return defaultConnectionName
+	}
+	return r.Connection
+}
+
+// nextRotation returns when the token is due for rotation, or the zero time if it is only rotated manually
+func (r *proxmoxStaticRoleEntry) nextRotation() time.Time {
+	if r.RotationPeriod <= 0 {
+		return time.Time{}
+	}
+	return r.LastRotated.Add(r.RotationPeriod)
+}
+
+func pathStaticRole(b *proxmoxBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "static-role/" + framework.GenericNameRegex("name"),
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the static role",
+					Required:    true,
+				},
+				"user": {
+					Type:        framework.TypeString,
+					Description: "User in Proxmox the managed token belongs to",
+					Required:    true,
+				},
+				"realm": {
+					Type:        framework.TypeString,
+					Description: "Realm of the user in Proxmox, e.g. pam",
+					Required:    true,
+				},
+				"token_id": {
+					Type:        framework.TypeString,
+					Description: "ID of the token managed by this role (excluding '<user>@<realm>!'), stays the same across rotations",
+					Required:    true,
+				},
+				"rotation_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "How often the token is recreated with a new secret. If not set or set to 0 the token is only rotated manually.",
+				},
+				"separated_privileges": {
+					Type:        framework.TypeBool,
+					Description: "Create the token with separated privileges, limited to the ACLs given in acls. Changing it rotates the token.",
+					Default:     false,
+				},
+				"acls": {
+					Type:        framework.TypeSlice,
+					Description: "List of ACL entries applied to the token, as objects with path, role and optional propagate (default true). Requires separated_privileges. Changing them rotates the token.",
+				},
+				"connection": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the connection configured at config/<name> the token lives on",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathStaticRolesRead,
+				},
+				logical.CreateOperation: &framework.PathOperation{
+					Callback: b.pathStaticRolesWrite,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathStaticRolesWrite,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathStaticRolesDelete,
+				},
+			},
+			ExistenceCheck:  b.pathStaticRoleExistenceCheck,
+			HelpSynopsis:    pathStaticRoleHelpSynopsis,
+			HelpDescription: pathStaticRoleHelpDescription,
+		},
+		{
+			Pattern: "static-role/?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathStaticRolesList,
+				},
+			},
+			HelpSynopsis:    pathStaticRoleListHelpSynopsis,
+			HelpDescription: pathStaticRoleListHelpDescription,
+		},
+		{
+			Pattern: "static-role/" + framework.GenericNameRegex("name") + "/rotate",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the static role",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathStaticRoleRotate,
+				},
+			},
+			HelpSynopsis:    pathStaticRoleRotateHelpSynopsis,
+			HelpDescription: pathStaticRoleRotateHelpDescription,
+		},
+	}
+}
+
+func (b *proxmoxBackend) pathStaticRoleExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	entry, err := b.getStaticRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, fmt.Errorf("existence check failed: %w", err)
+	}
+
+	return entry != nil, nil
+}
+
+func (b *proxmoxBackend) getStaticRole(ctx context.Context, s logical.Storage, name string) (*proxmoxStaticRoleEntry, error) {
+	if name == "" {
+		return nil, fmt.Errorf("missing static role name")
+	}
+
+	entry, err := s.Get(ctx, staticRoleStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var role proxmoxStaticRoleEntry
+
+	if err := entry.DecodeJSON(&role); err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+func setStaticRole(ctx context.Context, s logical.Storage, name string, roleEntry *proxmoxStaticRoleEntry) error {
+	entry, err := logical.StorageEntryJSON(staticRoleStoragePrefix+name, roleEntry)
+	if err != nil {
+		return err
+	}
+
+	if entry == nil {
+		return fmt.Errorf("failed to create storage entry for static role")
+	}
+
+	if err := s.Put(ctx, entry); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (b *proxmoxBackend) pathStaticRolesRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entry, err := b.getStaticRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: entry.toResponseData(),
+	}, nil
+}
+
+func (b *proxmoxBackend) pathStaticRolesWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, ok := d.GetOk("name")
+	if !ok {
+		return logical.ErrorResponse("missing static role name"), nil
+	}
+
+	b.staticRoleLock.Lock()
+	defer b.staticRoleLock.Unlock()
+
+	roleEntry, err := b.getStaticRole(ctx, req.Storage, name.(string))
+	if err != nil {
+		return nil, err
+	}
+
+	createOperation := roleEntry == nil
+	if createOperation {
+		roleEntry = &proxmoxStaticRoleEntry{
+			Name: name.(string),
+		}
+	}
+
+	if user, ok := d.GetOk("user"); ok && len(user.(string)) > 0 {
+		if !createOperation && roleEntry.User != user.(string) {
+			return logical.ErrorResponse("user cannot be changed on an existing static role"), nil
+		}
+		roleEntry.User = user.(string)
+	} else if createOperation {
+		return logical.ErrorResponse("missing user in static role"), nil
+	}
+
+	if realm, ok := d.GetOk("realm"); ok && len(realm.(string)) > 0 {
+		if !createOperation && roleEntry.Realm != realm.(string) {
+			return logical.ErrorResponse("realm cannot be changed on an existing static role"), nil
+		}
+		roleEntry.Realm = realm.(string)
+	} else if createOperation {
+		return logical.ErrorResponse("missing realm in static role"), nil
+	}
+
+	if tokenID, ok := d.GetOk("token_id"); ok && len(tokenID.(string)) > 0 {
+		if !createOperation && roleEntry.TokenID != tokenID.(string) {
+			return logical.ErrorResponse("token_id cannot be changed on an existing static role"), nil
+		}
+		roleEntry.TokenID = tokenID.(string)
+	} else if createOperation {
+		return logical.ErrorResponse("missing token_id in static role"), nil
+	}
+
+	if connection, ok := d.GetOk("connection"); ok && len(connection.(string)) > 0 {
+		if !createOperation && roleEntry.connection() != connection.(string) {
+			return logical.ErrorResponse("connection cannot be changed on an existing static role"), nil
+		}
+		roleEntry.Connection = connection.(string)
+	} else if createOperation {
+		roleEntry.Connection = defaultConnectionName
+	}
+
+	if resp, err := validateConnection(ctx, req.Storage, roleEntry.connection()); resp != nil || err != nil {
+		return resp, err
+	}
+
+	if !tokenIDRegex.MatchString(roleEntry.TokenID) {
+		return logical.ErrorResponse("invalid token_id %q, must match %s", roleEntry.TokenID, tokenIDRegex.String()), nil
+	}
+
+	if rotationPeriod, ok := d.GetOk("rotation_period"); ok {
+		roleEntry.RotationPeriod = time.Duration(rotationPeriod.(int)) * time.Second
+	}
+
+	if roleEntry.RotationPeriod != 0 && roleEntry.RotationPeriod < minRotationPeriod {
+		return logical.ErrorResponse("rotation_period must be at least %s", minRotationPeriod), nil
+	}
+
+	// Proxmox can't change the privilege separation of a token, and ACLs are only ever added, so the token is
+	// recreated for changes to either to take effect
+	oldSeparatedPrivileges := roleEntry.SeparatedPrivileges
+	oldACLs := roleEntry.ACLs
+
+	if separatedPrivileges, ok := d.GetOk("separated_privileges"); ok {
+		roleEntry.SeparatedPrivileges = separatedPrivileges.(bool)
+	}
+
+	if aclsRaw, ok := d.GetOk("acls"); ok {
+		acls, err := parseACLEntries(aclsRaw.([]interface{}))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		roleEntry.ACLs = acls
+	}
+
+	if len(roleEntry.ACLs) > 0 && !roleEntry.SeparatedPrivileges {
+		return logical.ErrorResponse("acls require separated_privileges to be enabled"), nil
+	}
+
+	privilegesChanged := roleEntry.SeparatedPrivileges != oldSeparatedPrivileges || !aclEntriesEqual(roleEntry.ACLs, oldACLs)
+
+	if createOperation || privilegesChanged {
+		// the token is created right away so the role never exists without credentials
+		if err := b.rotateStaticRole(ctx, req.Storage, roleEntry); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	if err := setStaticRole(ctx, req.Storage, roleEntry.Name, roleEntry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *proxmoxBackend) pathStaticRolesDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	b.staticRoleLock.Lock()
+	defer b.staticRoleLock.Unlock()
+
+	roleEntry, err := b.getStaticRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if roleEntry == nil {
+		return nil, nil
+	}
+
+	if roleEntry.Secret != "" {
+		client, err := b.getClient(ctx, req.Storage, roleEntry.connection())
+		if err != nil {
+			return nil, err
+		}
+
+		if err := b.deleteToken(ctx, client, roleEntry.User, roleEntry.Realm, roleEntry.TokenID); err != nil {
+			return nil, fmt.Errorf("error deleting token of static role: %w", err)
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, staticRoleStoragePrefix+name); err != nil {
+		return nil, fmt.Errorf("error deleting static role: %w", err)
+	}
+
+	return nil, nil
+}
+
+func (b *proxmoxBackend) pathStaticRolesList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entries, err := req.Storage.List(ctx, staticRoleStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(entries), nil
+}
+
+func (b *proxmoxBackend) pathStaticRoleRotate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.staticRoleLock.Lock()
+	defer b.staticRoleLock.Unlock()
+
+	roleEntry, err := b.getStaticRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if roleEntry == nil {
+		return logical.ErrorResponse("static role not found"), nil
+	}
+
+	if err := b.rotateStaticRole(ctx, req.Storage, roleEntry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// rotateStaticRole replaces the token of a static role with a newly created one and stores the new secret,
+// callers must hold staticRoleLock
+func (b *proxmoxBackend) rotateStaticRole(ctx context.Context, s logical.Storage, role *proxmoxStaticRoleEntry) error {
+	client, err := b.getClient(ctx, s, role.connection())
+	if err != nil {
+		return err
+	}
+
+	// Proxmox can't regenerate the secret of a token so it has to be recreated under the same ID
+	if role.Secret != "" {
+		if err := b.deleteToken(ctx, client, role.User, role.Realm, role.TokenID); err != nil {
+			return fmt.Errorf("error deleting token of static role '%v': %w", role.Name, err)
+		}
+	}
+
+	token, err := client.CreateToken(ctx, role.User, role.Realm, role.TokenID, vaultComment, 0, role.SeparatedPrivileges)
+	if err == nil && token == nil {
+		err = errors.New("no token returned")
+	}
+	if err != nil {
+		// the old token is gone, make sure the stale secret isn't handed out any more
+		b.clearStaticRoleSecret(ctx, s, role)
+		return fmt.Errorf("error creating token for static role '%v': %w", role.Name, err)
+	}
+
+	if len(role.ACLs) > 0 {
+		if err := client.SetTokenACLs(ctx, role.User, role.Realm, role.TokenID, role.ACLs); err != nil {
+			if delErr := client.DeleteToken(ctx, role.User, role.Realm, role.TokenID); delErr != nil {
+				b.Logger().Error("error deleting token of static role after failing to set ACLs", "role", role.Name, "error", delErr)
+			}
+			b.clearStaticRoleSecret(ctx, s, role)
+			return fmt.Errorf("error setting ACLs on token for static role '%v': %w", role.Name, err)
+		}
+	}
+
+	role.Secret = token.Secret
+	role.LastRotated = time.Now()
+
+	if err := setStaticRole(ctx, s, role.Name, role); err != nil {
+		return fmt.Errorf("error storing rotated token of static role '%v': %w", role.Name, err)
+	}
+
+	return nil
+}
+
+// clearStaticRoleSecret stores a static role without its secret once the token behind it is gone, so a stale
+// secret isn't handed out any more
+func (b *proxmoxBackend) clearStaticRoleSecret(ctx context.Context, s logical.Storage, role *proxmoxStaticRoleEntry) {
+	if role.Secret == "" {
+		return
+	}
+
+	role.Secret = ""
+	if err := setStaticRole(ctx, s, role.Name, role); err != nil {
+		b.Logger().Error("error clearing secret of static role", "role", role.Name, "error", err)
+	}
+}
+
+// rotateDueStaticRoles rotates the tokens of every static role that has passed its rotation period
+func (b *proxmoxBackend) rotateDueStaticRoles(ctx context.Context, s logical.Storage) error {
+	names, err := s.List(ctx, staticRoleStoragePrefix)
+	if err != nil {
+		return err
+	}
+
+	b.staticRoleLock.Lock()
+	defer b.staticRoleLock.Unlock()
+
+	var errs error
+	for _, name := range names {
+		role, err := b.getStaticRole(ctx, s, name)
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+
+		if role == nil {
+			continue
+		}
+
+		next := role.nextRotation()
+		if next.IsZero() || time.Now().Before(next) {
+			continue
+		}
+
+		b.Logger().Debug("rotating token of static role", "role", role.Name)
+		if err := b.rotateStaticRole(ctx, s, role); err != nil {
+			b.Logger().Error("error rotating token of static role", "role", role.Name, "error", err)
+			errs = errors.Join(errs, err)
+		}
+	}
+
+	return errs
+}
+
+const (
+	pathStaticRoleHelpSynopsis    = `Manages static roles that rotate a single Proxmox API token.`
+	pathStaticRoleHelpDescription = `
+This path allows you to read and write static roles. A static role manages one
+named API token for a Proxmox user, keeping the token ID stable while the secret
+is rotated every rotation_period. The current secret is read from "static-creds/".
+`
+
+	pathStaticRoleListHelpSynopsis    = `List the existing static roles in Proxmox backend`
+	pathStaticRoleListHelpDescription = `Static roles will be listed by the role name.`
+
+	pathStaticRoleRotateHelpSynopsis    = `Rotate the token of a static role.`
+	pathStaticRoleRotateHelpDescription = `
+This path recreates the token managed by a static role right away, giving it a
+new secret. The token ID stays the same.
+`
+)
@@ -0,0 +1,220 @@
+package proxmox
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	staticRoleName = "my_static_role"
+)
+
+func TestStaticRole(t *testing.T) {
+	b, s, _ := getTestBackend(t)
+
+	t.Run("Create Static Role - fail on missing token_id", func(t *testing.T) {
+		resp, err := testStaticRoleCreate(t, b, s, map[string]interface{}{
+			"user":  testUser,
+			"realm": testRealm,
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Static Role - fail on invalid token_id", func(t *testing.T) {
+		resp, err := testStaticRoleCreate(t, b, s, map[string]interface{}{
+			"user":     testUser,
+			"realm":    testRealm,
+			"token_id": "1password",
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Static Role - fail on short rotation_period", func(t *testing.T) {
+		resp, err := testStaticRoleCreate(t, b, s, map[string]interface{}{
+			"user":            testUser,
+			"realm":           testRealm,
+			"token_id":        "backup",
+			"rotation_period": "1m",
+		})
+
+		require.Nil(t, err)
+		require.NotNil(t, resp)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Static Role - fail without config", func(t *testing.T) {
+		_, err := testStaticRoleCreate(t, b, s, map[string]interface{}{
+			"user":            testUser,
+			"realm":           testRealm,
+			"token_id":        "backup",
+			"rotation_period": "24h",
+		})
+
+		require.Error(t, err)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "static-role/" + staticRoleName,
+			Storage:   s,
+		})
+
+		require.Nil(t, err)
+		require.Nil(t, resp)
+	})
+}
+
+// Utility function to create a static role, returning any response (including errors)
+func testStaticRoleCreate(t *testing.T, b *proxmoxBackend, s logical.Storage, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "static-role/" + staticRoleName,
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+func TestStaticRoleRotation(t *testing.T) {
+	b, s, fake := getTestBackend(t)
+
+	roleUserID := formatUserID(testUser, testRealm)
+	fake.addUser(roleUserID)
+	testFakeConnection(t, b, s, defaultConnectionName, fake)
+
+	resp, err := testStaticRoleCreate(t, b, s, map[string]interface{}{
+		"user":                 testUser,
+		"realm":                testRealm,
+		"token_id":             "backup",
+		"separated_privileges": true,
+		"acls": []interface{}{
+			map[string]interface{}{"path": "/vms/100", "role": "PVEVMUser"},
+		},
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	role, err := b.getStaticRole(context.Background(), s, staticRoleName)
+	require.NoError(t, err)
+	require.Equal(t, fake.token(roleUserID, "backup").Secret, role.Secret)
+
+	t.Run("Changing ACLs Rotates The Token", func(t *testing.T) {
+		oldSecret := role.Secret
+
+		resp, err := testStaticRoleUpdate(t, b, s, map[string]interface{}{
+			"acls": []interface{}{
+				map[string]interface{}{"path": "/vms/200", "role": "PVEVMUser"},
+			},
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		role, err = b.getStaticRole(context.Background(), s, staticRoleName)
+		require.NoError(t, err)
+		require.NotEqual(t, oldSecret, role.Secret)
+		require.Equal(t, fake.token(roleUserID, "backup").Secret, role.Secret)
+		require.Equal(t, []fakeACL{
+			{Path: "/vms/200", Type: "token", UGID: roleUserID + "!backup", RoleID: "PVEVMUser", Propagate: true},
+		}, fake.tokenACLs(roleUserID+"!backup"))
+	})
+
+	t.Run("Unchanged ACLs Keep The Token", func(t *testing.T) {
+		oldSecret := role.Secret
+
+		resp, err := testStaticRoleUpdate(t, b, s, map[string]interface{}{
+			"rotation_period": "24h",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		role, err = b.getStaticRole(context.Background(), s, staticRoleName)
+		require.NoError(t, err)
+		require.Equal(t, oldSecret, role.Secret)
+	})
+
+	t.Run("Failed ACLs Clear The Secret", func(t *testing.T) {
+		fake.inject(fakeFault{Method: http.MethodPut, Path: "/access/acl", Status: http.StatusBadRequest, Reason: "Parameter verification failed."})
+
+		resp, err := testStaticRoleUpdate(t, b, s, map[string]interface{}{
+			"acls": []interface{}{
+				map[string]interface{}{"path": "/vms/300", "role": "PVEVMUser"},
+			},
+		})
+		require.Error(t, err)
+		require.Nil(t, resp)
+
+		require.Nil(t, fake.token(roleUserID, "backup"))
+
+		role, err = b.getStaticRole(context.Background(), s, staticRoleName)
+		require.NoError(t, err)
+		require.Empty(t, role.Secret)
+	})
+}
+
+// Utility function to update the static role, returning any response (including errors)
+func testStaticRoleUpdate(t *testing.T, b *proxmoxBackend, s logical.Storage, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "static-role/" + staticRoleName,
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+func TestStaticRoleTokenDeletedInProxmox(t *testing.T) {
+	b, s, fake := getTestBackend(t)
+
+	roleUserID := formatUserID(testUser, testRealm)
+	fake.addUser(roleUserID)
+	testFakeConnection(t, b, s, defaultConnectionName, fake)
+
+	resp, err := testStaticRoleCreate(t, b, s, map[string]interface{}{
+		"user":     testUser,
+		"realm":    testRealm,
+		"token_id": "backup",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	t.Run("Rotate", func(t *testing.T) {
+		fake.removeToken(roleUserID, "backup")
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "static-role/" + staticRoleName + "/rotate",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		role, err := b.getStaticRole(context.Background(), s, staticRoleName)
+		require.NoError(t, err)
+		require.Equal(t, fake.token(roleUserID, "backup").Secret, role.Secret)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		fake.removeToken(roleUserID, "backup")
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "static-role/" + staticRoleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		role, err := b.getStaticRole(context.Background(), s, staticRoleName)
+		require.NoError(t, err)
+		require.Nil(t, role)
+	})
+}
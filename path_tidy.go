@@ -0,0 +1,284 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	tidyReasonOrphaned = "orphaned"
+	tidyReasonExpired  = "expired"
+)
+
+// tidyUser is a Proxmox user whose tokens are checked by tidy
+type tidyUser struct {
+	Connection string
+	User       string
+	Realm      string
+}
+
+// tidiedToken is a token removed, or found to be removable, by tidy
+type tidiedToken struct {
+	Connection  string
+	TokenIDFull string
+	Reason      string
+}
+
+func (t tidiedToken) toResponseData() map[string]interface{} {
+	return map[string]interface{}{
+		"connection":    t.Connection,
+		"token_id_full": t.TokenIDFull,
+		"reason":        t.Reason,
+	}
+}
+
+func pathTidy(b *proxmoxBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "tidy",
+		Fields: map[string]*framework.FieldSchema{
+			"dry_run": {
+				Type:        framework.TypeBool,
+				Description: "Only report the tokens that would be removed",
+				Default:     false,
+			},
+			"remove_orphaned": {
+				Type:        framework.TypeBool,
+				Description: "Also remove tokens created by Vault that don't belong to any lease. Leases issued before tokens were tracked look the same, run with dry_run=true first.",
+				Default:     false,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathTidyUpdate,
+			},
+		},
+		HelpSynopsis:    pathTidyHelpSynopsis,
+		HelpDescription: pathTidyHelpDescription,
+	}
+}
+
+func (b *proxmoxBackend) pathTidyUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	dryRun := data.Get("dry_run").(bool)
+	removeOrphaned := data.Get("remove_orphaned").(bool)
+
+	tidied, err := b.tidyTokens(ctx, req.Storage, dryRun, removeOrphaned)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := make([]map[string]interface{}, 0, len(tidied))
+	for _, token := range tidied {
+		removed = append(removed, token.toResponseData())
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"dry_run": dryRun,
+			"removed": removed,
+		},
+	}, nil
+}
+
+// tidyTokens removes tokens created by Vault that have expired in Proxmox, and with removeOrphaned those that
+// no longer belong to a lease, for all users referenced by roles
+func (b *proxmoxBackend) tidyTokens(ctx context.Context, s logical.Storage, dryRun bool, removeOrphaned bool) ([]tidiedToken, error) {
+	if !b.tidyLock.TryLock() {
+		return nil, errors.New("tidy is already running")
+	}
+	defer b.tidyLock.Unlock()
+
+	// root and static role tokens exist in Proxmox before their configuration is stored, keep them from being
+	// created while tidy runs so none of them is mistaken for an orphan
+	b.rotateRootLock.Lock()
+	defer b.rotateRootLock.Unlock()
+	b.staticRoleLock.RLock()
+	defer b.staticRoleLock.RUnlock()
+
+	users, err := b.tidyUsers(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	keep, err := b.tidyKeepTokens(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	var tidied []tidiedToken
+	var errs error
+	now := time.Now()
+
+	for _, user := range users {
+		client, err := b.getClient(ctx, s, user.Connection)
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+
+		tokens, err := client.ListTokens(ctx, user.User, user.Realm)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("error listing tokens of %s@%s: %w", user.User, user.Realm, err))
+			continue
+		}
+
+		for _, token := range tokens {
+			if !strings.HasPrefix(token.Comment, vaultComment) {
+				continue
+			}
+
+			fullTokenID := fmt.Sprintf("%s@%s!%s", user.User, user.Realm, token.TokenID)
+			if keep[user.Connection+"/"+fullTokenID] {
+				continue
+			}
+
+			// the index is read after listing the tokens, tokens are indexed before they are created so one
+			// issued in the meantime has its entry by now
+			indexEntry, err := getTokenIndexEntry(ctx, s, token.TokenID)
+			if err != nil {
+				errs = errors.Join(errs, err)
+				continue
+			}
+
+			// the same ID may be indexed for the token of another user, whose lease is none of tidy's business
+			if indexEntry != nil && !indexEntry.belongsTo(user.Connection, user.User, user.Realm) {
+				indexEntry = nil
+			}
+
+			var reason string
+			switch {
+			case token.Expire > 0 && now.After(time.Unix(token.Expire, 0)):
+				reason = tidyReasonExpired
+			case indexEntry == nil && removeOrphaned:
+				reason = tidyReasonOrphaned
+			default:
+				continue
+			}
+
+			if !dryRun {
+				revoke := &proxmoxToken{
+					TokenID:       token.TokenID,
+					User:          user.User,
+					Realm:         user.Realm,
+					PrivilegeRole: privilegeRoleID(token.TokenID),
+				}
+
+				exists, err := client.RoleExists(ctx, revoke.PrivilegeRole)
+				if err != nil {
+					errs = errors.Join(errs, err)
+					continue
+				}
+				if !exists {
+					revoke.PrivilegeRole = ""
+				}
+
+				if err := b.revokeToken(ctx, client, revoke, false); err != nil {
+					errs = errors.Join(errs, fmt.Errorf("error removing token %s: %w", fullTokenID, err))
+					continue
+				}
+
+				if indexEntry != nil {
+					// the lease is revoked without touching Proxmox once its index entry is gone
+					if err := deleteTokenIndexEntry(ctx, s, token.TokenID); err != nil {
+						errs = errors.Join(errs, err)
+						continue
+					}
+				}
+
+				b.Logger().Info("tidied token", "connection", user.Connection, "token_id_full", fullTokenID, "reason", reason)
+			}
+
+			tidied = append(tidied, tidiedToken{
+				Connection:  user.Connection,
+				TokenIDFull: fullTokenID,
+				Reason:      reason,
+			})
+		}
+	}
+
+	return tidied, errs
+}
+
+// tidyUsers returns the users whose tokens are issued by roles, ephemeral users are deleted with their lease
+func (b *proxmoxBackend) tidyUsers(ctx context.Context, s logical.Storage) ([]tidyUser, error) {
+	roleNames, err := s.List(ctx, "role/")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[tidyUser]bool)
+	var users []tidyUser
+
+	for _, name := range roleNames {
+		role, err := b.getRole(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if role == nil || role.EphemeralUser || role.credentialType() != credentialTypeAPIToken {
+			continue
+		}
+
+		user := tidyUser{Connection: role.connection(), User: role.User, Realm: role.Realm}
+		if !seen[user] {
+			seen[user] = true
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+// tidyKeepTokens returns the tokens created by Vault that aren't issued for leases, i.e. the root tokens of
+// every connection and the tokens of static roles, keyed by connection and full token ID
+func (b *proxmoxBackend) tidyKeepTokens(ctx context.Context, s logical.Storage) (map[string]bool, error) {
+	keep := make(map[string]bool)
+
+	connections, err := listConnections(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, connection := range connections {
+		config, err := getConfig(ctx, s, connection)
+		if err != nil {
+			return nil, err
+		}
+		if config != nil {
+			keep[fmt.Sprintf("%s/%s@%s!%s", connection, config.User, config.Realm, config.ApiTokenID)] = true
+		}
+	}
+
+	staticRoleNames, err := s.List(ctx, staticRoleStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range staticRoleNames {
+		role, err := b.getStaticRole(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+		if role != nil {
+			keep[fmt.Sprintf("%s/%s@%s!%s", role.connection(), role.User, role.Realm, role.TokenID)] = true
+		}
+	}
+
+	return keep, nil
+}
+
+const pathTidyHelpSynopsis = `Remove leftover API tokens created by Vault.`
+
+const pathTidyHelpDescription = `
+This path looks at the tokens of every user referenced by a role and removes those created by
+Vault that have expired in Proxmox. With remove_orphaned=true it also removes those that don't
+belong to any lease any more, e.g. after a restore of Vault. Root tokens and static role tokens
+are never removed.
+
+Leases issued before tokens were tracked look orphaned too, run with dry_run=true first.
+`
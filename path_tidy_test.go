@@ -0,0 +1,175 @@
+package proxmox
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTidy(t *testing.T) {
+	b, s, _ := getTestBackend(t)
+
+	t.Run("Tidy Without Roles", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "tidy",
+			Storage:   s,
+		})
+
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.Empty(t, resp.Data["removed"])
+	})
+
+	t.Run("Auto Tidy - fail on short interval", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config/auto-tidy",
+			Data: map[string]interface{}{
+				"enabled":  true,
+				"interval": "1m",
+			},
+			Storage: s,
+		})
+
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Auto Tidy", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config/auto-tidy",
+			Data: map[string]interface{}{
+				"enabled": true,
+			},
+			Storage: s,
+		})
+
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		require.NoError(t, b.tidyIfDue(context.Background(), s))
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "config/auto-tidy",
+			Storage:   s,
+		})
+
+		require.NoError(t, err)
+		require.Equal(t, true, resp.Data["enabled"])
+		require.Equal(t, int(defaultAutoTidyInterval.Seconds()), resp.Data["interval"])
+
+		config, err := getAutoTidyConfig(context.Background(), s)
+		require.NoError(t, err)
+		require.False(t, config.LastTidy.IsZero())
+	})
+
+	t.Run("Auto Tidy Is Not A Connection", func(t *testing.T) {
+		connections, err := listConnections(context.Background(), s)
+		require.NoError(t, err)
+		require.Empty(t, connections)
+	})
+}
+
+func TestTidyTokens(t *testing.T) {
+	b, s, fake := getTestBackend(t)
+
+	roleUserID := formatUserID(testUser, testRealm)
+	fake.addUser(roleUserID)
+	testFakeConnection(t, b, s, defaultConnectionName, fake)
+
+	resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"user":  testUser,
+		"realm": testRealm,
+	})
+	require.Nil(t, err)
+	require.Nil(t, resp)
+
+	// a token created by Vault that no lease knows about
+	_, err = b.createToken(context.Background(), &logical.Request{Storage: s}, &proxmoxRoleEntry{Name: roleName, User: testUser, Realm: testRealm}, testUser, "orphan", 0)
+	require.NoError(t, err)
+
+	t.Run("Orphans Are Only Removed On Request", func(t *testing.T) {
+		resp, err := testTidy(t, b, s, map[string]interface{}{})
+		require.NoError(t, err)
+		require.Empty(t, resp.Data["removed"])
+		require.NotNil(t, fake.token(roleUserID, "orphan"))
+
+		resp, err = testTidy(t, b, s, map[string]interface{}{"remove_orphaned": true})
+		require.NoError(t, err)
+		require.Equal(t, []map[string]interface{}{
+			{"connection": defaultConnectionName, "token_id_full": roleUserID + "!orphan", "reason": tidyReasonOrphaned},
+		}, resp.Data["removed"])
+		require.Nil(t, fake.token(roleUserID, "orphan"))
+	})
+
+	t.Run("Index Entries Of Other Users Are Kept", func(t *testing.T) {
+		expired := time.Now().Add(-time.Hour).Unix()
+		_, err := b.createToken(context.Background(), &logical.Request{Storage: s}, &proxmoxRoleEntry{Name: roleName, User: testUser, Realm: testRealm}, testUser, "shared", expired)
+		require.NoError(t, err)
+
+		// a live lease on another user has a token with the same ID
+		require.NoError(t, putTokenIndexEntry(context.Background(), s, &tokenIndexEntry{
+			TokenID:    "shared",
+			User:       "other",
+			Realm:      testRealm,
+			Connection: defaultConnectionName,
+			Role:       "other",
+		}))
+
+		resp, err := testTidy(t, b, s, map[string]interface{}{})
+		require.NoError(t, err)
+		require.Equal(t, []map[string]interface{}{
+			{"connection": defaultConnectionName, "token_id_full": roleUserID + "!shared", "reason": tidyReasonExpired},
+		}, resp.Data["removed"])
+		require.Nil(t, fake.token(roleUserID, "shared"))
+
+		entry, err := getTokenIndexEntry(context.Background(), s, "shared")
+		require.NoError(t, err)
+		require.NotNil(t, entry)
+
+		require.NoError(t, deleteTokenIndexEntry(context.Background(), s, "shared"))
+	})
+
+	t.Run("Tokens Issued During Tidy Are Kept", func(t *testing.T) {
+		fake.inject(fakeFault{Method: http.MethodGet, Path: "/access/users/" + roleUserID + "/token", Delay: 500 * time.Millisecond, Times: 1})
+
+		type tidyResult struct {
+			resp *logical.Response
+			err  error
+		}
+		done := make(chan tidyResult)
+		go func() {
+			resp, err := testTidy(t, b, s, map[string]interface{}{"remove_orphaned": true})
+			done <- tidyResult{resp, err}
+		}()
+
+		// issued while tidy waits for the token list, which then includes it
+		time.Sleep(100 * time.Millisecond)
+		resp, err := testCredsRead(t, b, s, roleName)
+		require.NoError(t, err)
+		tokenID := resp.Data["token_id"].(string)
+
+		result := <-done
+		require.NoError(t, result.err)
+		require.Empty(t, result.resp.Data["removed"])
+		require.NotNil(t, fake.token(roleUserID, tokenID))
+	})
+}
+
+// testTidy runs tidy
+func testTidy(t *testing.T, b *proxmoxBackend, s logical.Storage, d map[string]interface{}) (*logical.Response, error) {
+	t.Helper()
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "tidy",
+		Data:      d,
+		Storage:   s,
+	})
+}
@@ -0,0 +1,84 @@
+package proxmox
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathTokens(b *proxmoxBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "role/" + framework.GenericNameRegex("name") + "/tokens/?$",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the role",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathRoleTokensList,
+				},
+			},
+			HelpSynopsis:    pathRoleTokensHelpSynopsis,
+			HelpDescription: pathRoleTokensHelpDescription,
+		},
+		{
+			Pattern: "token/" + framework.GenericNameRegex("token_id"),
+			Fields: map[string]*framework.FieldSchema{
+				"token_id": {
+					Type:        framework.TypeString,
+					Description: "ID of the token (excluding '<user>@<realm>!')",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathTokenRead,
+				},
+			},
+			HelpSynopsis:    pathTokenHelpSynopsis,
+			HelpDescription: pathTokenHelpDescription,
+		},
+	}
+}
+
+func (b *proxmoxBackend) pathRoleTokensList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	tokenIDs, err := listRoleTokens(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(tokenIDs), nil
+}
+
+func (b *proxmoxBackend) pathTokenRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entry, err := getTokenIndexEntry(ctx, req.Storage, d.Get("token_id").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: entry.toResponseData(),
+	}, nil
+}
+
+const pathRoleTokensHelpSynopsis = `List the live tokens issued for a role.`
+
+const pathRoleTokensHelpDescription = `
+Tokens will be listed by their ID, for as long as their lease exists.
+`
+
+const pathTokenHelpSynopsis = `Show a token issued for a lease.`
+
+const pathTokenHelpDescription = `
+This path shows who a token was issued to and when, and when it expires in Proxmox.
+The secret of the token is never stored.
+`
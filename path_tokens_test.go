@@ -0,0 +1,71 @@
+package proxmox
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenIndex(t *testing.T) {
+	b, s, _ := getTestBackend(t)
+
+	created := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	entry := &tokenIndexEntry{
+		TokenID:    "abc-def",
+		User:       testUser,
+		Realm:      testRealm,
+		Connection: defaultConnectionName,
+		Role:       roleName,
+		EntityID:   "entity-1",
+		CreatedAt:  created,
+		Expire:     created.Add(time.Hour).Unix(),
+	}
+
+	require.NoError(t, putTokenIndexEntry(context.Background(), s, entry))
+
+	t.Run("List Role Tokens", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "role/" + roleName + "/tokens/",
+			Storage:   s,
+		})
+
+		require.NoError(t, err)
+		require.Equal(t, []string{"abc-def"}, resp.Data["keys"])
+	})
+
+	t.Run("Read Token", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "token/abc-def",
+			Storage:   s,
+		})
+
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, testUser+"@"+testRealm+"!abc-def", resp.Data["token_id_full"])
+		require.Equal(t, "entity-1", resp.Data["entity_id"])
+		require.Equal(t, "2023-05-01T12:00:00Z", resp.Data["created_at"])
+		require.Equal(t, "2023-05-01T13:00:00Z", resp.Data["expires_at"])
+	})
+
+	t.Run("Delete Token", func(t *testing.T) {
+		require.NoError(t, deleteTokenIndexEntry(context.Background(), s, "abc-def"))
+
+		tokenIDs, err := listRoleTokens(context.Background(), s, roleName)
+		require.NoError(t, err)
+		require.Empty(t, tokenIDs)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "token/abc-def",
+			Storage:   s,
+		})
+
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	})
+}
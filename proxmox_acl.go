@@ -0,0 +1,145 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"strconv"
+	"strings"
+)
+
+type proxmoxACLEntry struct {
+	Path      string `json:"path"`
+	Role      string `json:"role"`
+	Propagate bool   `json:"propagate"`
+}
+
+func (a proxmoxACLEntry) toResponseData() map[string]interface{} {
+	return map[string]interface{}{
+		"path":      a.Path,
+		"role":      a.Role,
+		"propagate": a.Propagate,
+	}
+}
+
+func aclEntriesToResponseData(acls []proxmoxACLEntry) []map[string]interface{} {
+	respData := make([]map[string]interface{}, 0, len(acls))
+	for _, acl := range acls {
+		respData = append(respData, acl.toResponseData())
+	}
+	return respData
+}
+
+func parseACLEntries(raw []interface{}) ([]proxmoxACLEntry, error) {
+	acls := make([]proxmoxACLEntry, 0, len(raw))
+
+	for i, entryRaw := range raw {
+		entry, ok := entryRaw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("acl entry %d must be an object with path, role and propagate", i)
+		}
+
+		acl := proxmoxACLEntry{Propagate: true}
+
+		if path, ok := entry["path"].(string); ok {
+			acl.Path = path
+		}
+		if !strings.HasPrefix(acl.Path, "/") {
+			return nil, fmt.Errorf("acl entry %d has invalid path %q, must start with '/'", i, acl.Path)
+		}
+
+		if role, ok := entry["role"].(string); ok {
+			acl.Role = role
+		}
+		if len(acl.Role) == 0 {
+			return nil, fmt.Errorf("acl entry %d is missing role", i)
+		}
+
+		switch propagate := entry["propagate"].(type) {
+		case nil:
+		case bool:
+			acl.Propagate = propagate
+		case string:
+			b, err := strconv.ParseBool(propagate)
+			if err != nil {
+				return nil, fmt.Errorf("acl entry %d has invalid propagate value %q", i, propagate)
+			}
+			acl.Propagate = b
+		default:
+			return nil, fmt.Errorf("acl entry %d has invalid propagate value %v", i, propagate)
+		}
+
+		acls = append(acls, acl)
+	}
+
+	return acls, nil
+}
+
+// aclEntriesEqual reports whether two lists hold the same ACL entries in the same order
+func aclEntriesEqual(a []proxmoxACLEntry, b []proxmoxACLEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *httpClient) SetTokenACLs(ctx context.Context, user string, realm string, tokenID string, acls []proxmoxACLEntry) error {
+	if len(tokenID) == 0 {
+		return errors.New("error setting token ACLs: no token provided")
+	}
+
+	fullTokenID := fmt.Sprintf("%s@%s!%s", user, realm, tokenID)
+
+	for _, acl := range acls {
+		err := c.put(ctx, "/access/acl", neturl.Values{
+			"path":      {acl.Path},
+			"roles":     {acl.Role},
+			"tokens":    {fullTokenID},
+			"propagate": {boolParam(acl.Propagate)},
+		})
+		if err != nil {
+			return fmt.Errorf("error from API when setting ACL for role '%s' on path '%s': %w", acl.Role, acl.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// GetTokenACLs returns the ACL entries granted directly to a token
+func (c *httpClient) GetTokenACLs(ctx context.Context, user string, realm string, tokenID string) ([]proxmoxACLEntry, error) {
+	fullTokenID := fmt.Sprintf("%s@%s!%s", user, realm, tokenID)
+
+	var entries []interface{}
+	if err := c.get(ctx, "/access/acl", nil, &entries); err != nil {
+		return nil, fmt.Errorf("error from API when listing ACLs: %w", err)
+	}
+
+	var acls []proxmoxACLEntry
+	for _, entryRaw := range entries {
+		entry, ok := entryRaw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if entry["type"] != "token" || entry["ugid"] != fullTokenID {
+			continue
+		}
+
+		acl := proxmoxACLEntry{}
+		acl.Path, _ = entry["path"].(string)
+		acl.Role, _ = entry["roleid"].(string)
+		if propagate, ok := entry["propagate"].(float64); ok {
+			acl.Propagate = propagate != 0
+		}
+
+		acls = append(acls, acl)
+	}
+
+	return acls, nil
+}
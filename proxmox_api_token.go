@@ -4,21 +4,61 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	neturl "net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
-	pxapi "github.com/Telmate/proxmox-api-go/proxmox"
 	"github.com/google/uuid"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/template"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
 const (
 	proxmoxTokenType = "proxmox_api_token"
+
+	// vaultComment marks tokens and users created by Vault, tidy only ever removes tokens carrying it
+	vaultComment = "Managed by Vault"
+
+	// Proxmox doesn't document a limit for token IDs, but stores them in its user.cfg along with
+	// user IDs which are limited to 64 characters
+	maxTokenIDLength = 64
+
+	maxTokenIDAttempts = 3
+
+	// defaultTokenExpiryGrace is how long after the end of their lease tokens expire in Proxmox by default
+	defaultTokenExpiryGrace = 5 * time.Minute
 )
 
+var errTokenExists = errors.New("token ID already exists")
+
+// invalidTokenIDCharRegex matches characters Proxmox doesn't allow in token IDs
+var invalidTokenIDCharRegex = regexp.MustCompile(`[^A-Za-z0-9.\-_]`)
+
+// tokenIDTemplateData is available to token_id_template
+type tokenIDTemplateData struct {
+	RoleName    string
+	DisplayName string
+}
+
+// tokenCommentTemplateData is available to comment_template
+type tokenCommentTemplateData struct {
+	EntityID      string
+	DisplayName   string
+	RequestID     string
+	RoleName      string
+	MountAccessor string
+}
+
 type proxmoxToken struct {
-	TokenID string `json:"token_id"`
-	Secret  string `json:"secret"`
+	TokenID       string `json:"token_id"`
+	Secret        string `json:"secret"`
+	User          string `json:"user"`
+	Realm         string `json:"realm"`
+	PrivilegeRole string `json:"privilege_role,omitempty"`
+	EphemeralUser bool   `json:"ephemeral_user,omitempty"`
 }
 
 func (b *proxmoxBackend) proxmoxToken() *framework.Secret {
@@ -40,11 +80,6 @@ func (b *proxmoxBackend) proxmoxToken() *framework.Secret {
 }
 
 func (b *proxmoxBackend) tokenRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	client, err := b.getClient(ctx, req.Storage)
-	if err != nil {
-		return nil, fmt.Errorf("error getting client: %w", err)
-	}
-
 	tokenID := ""
 	tokenIDRaw, ok := req.Secret.InternalData["token_id"]
 	if ok {
@@ -54,25 +89,101 @@ func (b *proxmoxBackend) tokenRevoke(ctx context.Context, req *logical.Request,
 		}
 	}
 
+	token := &proxmoxToken{
+		TokenID: tokenID,
+	}
+
+	// tokens deleted together with their role or by tidy are already gone, along with their index entry
+	var indexEntry *tokenIndexEntry
+	if indexed, _ := req.Secret.InternalData["indexed"].(bool); indexed {
+		entry, err := getTokenIndexEntry(ctx, req.Storage, tokenID)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			b.Logger().Info("token was already removed, nothing to revoke", "token_id", tokenID)
+			return nil, nil
+		}
+		indexEntry = entry
+	}
+
+	if privilegeRole, ok := req.Secret.InternalData["privilege_role"].(string); ok {
+		token.PrivilegeRole = privilegeRole
+	}
+
+	token.EphemeralUser, _ = req.Secret.InternalData["ephemeral_user"].(bool)
+
+	user, realm, connection, err := b.secretOwner(ctx, req, indexEntry)
+	if err != nil {
+		return nil, err
+	}
+	token.User = user
+	token.Realm = realm
+
+	client, err := b.getClient(ctx, req.Storage, connection)
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %w", err)
+	}
+
+	verify, err := b.verifyRevocation(ctx, req.Storage, connection)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.revokeToken(ctx, client, token, verify); err != nil {
+		return nil, fmt.Errorf("error revoking user token: %w", err)
+	}
+
+	if err := deleteTokenIndexEntry(ctx, req.Storage, token.TokenID); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// secretOwner returns the user, realm and connection a lease was issued on. Leases store them when issued,
+// older leases fall back to what the token index or their role says now.
+func (b *proxmoxBackend) secretOwner(ctx context.Context, req *logical.Request, indexEntry *tokenIndexEntry) (string, string, string, error) {
+	connection, _ := req.Secret.InternalData["connection"].(string)
+
+	if userID, ok := req.Secret.InternalData["user_id"].(string); ok && userID != "" {
+		user, realm, err := splitUserID(userID)
+		if err != nil {
+			return "", "", "", fmt.Errorf("invalid user_id in secret internal data: %w", err)
+		}
+		return user, realm, connection, nil
+	}
+
+	// leases of ephemeral users always stored user and realm separately
+	user, _ := req.Secret.InternalData["user"].(string)
+	realm, _ := req.Secret.InternalData["realm"].(string)
+	if user != "" && realm != "" {
+		return user, realm, connection, nil
+	}
+
+	if indexEntry != nil {
+		return indexEntry.User, indexEntry.Realm, indexEntry.Connection, nil
+	}
+
+	// leases issued before any of this was stored, which were all issued on the default connection
 	roleRaw, ok := req.Secret.InternalData["role"]
 	if !ok {
-		return nil, fmt.Errorf("secret is missing role internal data")
+		return "", "", "", fmt.Errorf("secret is missing role internal data")
 	}
 
-	role := roleRaw.(string)
-	roleEntry, err := b.getRole(ctx, req.Storage, role)
+	roleEntry, err := b.getRole(ctx, req.Storage, roleRaw.(string))
 	if err != nil {
-		return nil, fmt.Errorf("error retrieving role: %w", err)
+		return "", "", "", fmt.Errorf("error retrieving role: %w", err)
 	}
 	if roleEntry == nil {
-		return nil, errors.New("error retrieving role: role is nil")
+		return "", "", "", errors.New("error retrieving role: role is nil")
 	}
 
-	if err := deleteToken(ctx, client, roleEntry.User, roleEntry.Realm, tokenID); err != nil {
-		return nil, fmt.Errorf("error revoking user token: %w", err)
+	if connection == "" {
+		connection = roleEntry.connection()
 	}
 
-	return nil, nil
+	return roleEntry.User, roleEntry.Realm, connection, nil
 }
 
 func (b *proxmoxBackend) tokenRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
@@ -81,29 +192,178 @@ func (b *proxmoxBackend) tokenRenew(ctx context.Context, req *logical.Request, d
 		return nil, fmt.Errorf("secret is missing role internal data")
 	}
 
+	tokenID, _ := req.Secret.InternalData["token_id"].(string)
+
+	var indexEntry *tokenIndexEntry
+	if indexed, _ := req.Secret.InternalData["indexed"].(bool); indexed {
+		entry, err := getTokenIndexEntry(ctx, req.Storage, tokenID)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return nil, errors.New("token was removed together with its role or by tidy and can't be renewed")
+		}
+		indexEntry = entry
+	}
+
 	role := roleRaw.(string)
 	roleEntry, err := b.getRole(ctx, req.Storage, role)
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving role: %w", err)
 	}
-	if roleEntry == nil {
-		return nil, errors.New("error retrieving role: role is nil")
+
+	// without its role the lease keeps the limits of the mount
+	var roleTTL, roleMaxTTL time.Duration
+	if roleEntry != nil {
+		roleTTL = roleEntry.TTL
+		roleMaxTTL = roleEntry.MaxTTL
+	}
+
+	ttl, warnings, err := framework.CalculateTTL(b.System(), req.Secret.Increment, roleTTL, 0, roleMaxTTL, 0, req.Secret.IssueTime)
+	if err != nil {
+		return nil, err
+	}
+
+	user, realm, connection, err := b.secretOwner(ctx, req, indexEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := b.getClient(ctx, req.Storage, connection)
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %w", err)
+	}
+
+	// the token would otherwise stop working in Proxmox at the expiry it was created with
+	expire, err := tokenExpire(ctx, req.Storage, connection, time.Now(), ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	if ephemeralUser, _ := req.Secret.InternalData["ephemeral_user"].(bool); ephemeralUser {
+		if err := client.SetUserExpire(ctx, user, realm, expire); err != nil {
+			return nil, fmt.Errorf("error extending user expiry: %w", err)
+		}
 	}
 
-	resp := &logical.Response{Secret: req.Secret}
+	if err := client.SetTokenExpire(ctx, user, realm, tokenID, expire); err != nil {
+		return nil, fmt.Errorf("error extending token expiry: %w", err)
+	}
 
-	if roleEntry.TTL > 0 {
-		resp.Secret.TTL = roleEntry.TTL
+	if indexEntry != nil {
+		indexEntry.Expire = expire
+		if err := putTokenIndexEntry(ctx, req.Storage, indexEntry); err != nil {
+			return nil, err
+		}
 	}
 
-	if roleEntry.MaxTTL > 0 {
-		resp.Secret.MaxTTL = roleEntry.MaxTTL
+	resp := &logical.Response{Secret: req.Secret, Warnings: warnings}
+	resp.Secret.TTL = ttl
+	if roleMaxTTL > 0 {
+		resp.Secret.MaxTTL = roleMaxTTL
 	}
 
 	return resp, nil
 }
 
-func createToken(ctx context.Context, c *proxmoxClient, user string, realm string, expire int64, privsep bool) (*proxmoxToken, error) {
+// tokenExpire returns when Proxmox should stop accepting the token of a lease that ends after ttl. Tokens of
+// leases always expire, a grace period after the lease so that Proxmox only steps in if revoking it failed.
+func tokenExpire(ctx context.Context, s logical.Storage, connection string, now time.Time, ttl time.Duration) (int64, error) {
+	if ttl <= 0 {
+		return 0, errors.New("lease TTL must be greater than zero")
+	}
+
+	config, err := getConfig(ctx, s, connection)
+	if err != nil {
+		return 0, err
+	}
+
+	grace := defaultTokenExpiryGrace
+	if config != nil {
+		grace = config.tokenExpiryGrace()
+	}
+
+	return now.Add(ttl + grace).Unix(), nil
+}
+
+// newTokenID generates a random token ID
+func newTokenID() string {
+	rawTokenId := uuid.New().String()
+	// Proxmox API wants token IDs to start with a latter (regexp (?^:[A-Za-z][A-Za-z0-9\.\-_]+)) so lets remap the entire thing
+	return strings.NewReplacer("0", "g", "1", "h", "2", "i", "3", "j", "4", "k", "5", "l", "6", "m", "7", "n", "8", "o", "9", "p").Replace(rawTokenId)
+}
+
+// renderTokenID generates the ID of a new token from a role's token_id_template, or a random one
+// if it has none
+func renderTokenID(rawTemplate string, roleName string, displayName string) (string, error) {
+	if rawTemplate == "" {
+		return newTokenID(), nil
+	}
+
+	tmpl, err := template.NewTemplate(template.Template(rawTemplate))
+	if err != nil {
+		return "", fmt.Errorf("invalid token_id_template: %w", err)
+	}
+
+	// display names of auth methods like OIDC and LDAP contain characters such as '@'
+	tokenID, err := tmpl.Generate(tokenIDTemplateData{
+		RoleName:    roleName,
+		DisplayName: invalidTokenIDCharRegex.ReplaceAllString(displayName, "-"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error rendering token_id_template: %w", err)
+	}
+
+	if err := validateTokenID(tokenID); err != nil {
+		return "", err
+	}
+
+	return tokenID, nil
+}
+
+func validateTokenID(tokenID string) error {
+	if !tokenIDRegex.MatchString(tokenID) {
+		return fmt.Errorf("invalid token ID %q, must match %s", tokenID, tokenIDRegex.String())
+	}
+
+	if len(tokenID) > maxTokenIDLength {
+		return fmt.Errorf("invalid token ID %q, must be at most %d characters", tokenID, maxTokenIDLength)
+	}
+
+	return nil
+}
+
+// renderTokenComment generates the comment of a new token from a role's comment_template. The comment always
+// starts with vaultComment, tidy relies on it to tell tokens created by Vault apart.
+func renderTokenComment(rawTemplate string, data tokenCommentTemplateData) (string, error) {
+	if rawTemplate == "" {
+		return vaultComment, nil
+	}
+
+	tmpl, err := template.NewTemplate(template.Template(rawTemplate))
+	if err != nil {
+		return "", fmt.Errorf("invalid comment_template: %w", err)
+	}
+
+	comment, err := tmpl.Generate(data)
+	if err != nil {
+		return "", fmt.Errorf("error rendering comment_template: %w", err)
+	}
+
+	// Proxmox stores comments on a single line of its user.cfg
+	if strings.ContainsAny(comment, "\r\n") {
+		return "", errors.New("invalid token comment, must be a single line")
+	}
+
+	comment = strings.TrimSpace(comment)
+	if comment == "" {
+		return vaultComment, nil
+	}
+
+	return vaultComment + ": " + comment, nil
+}
+
+func (c *httpClient) CreateToken(ctx context.Context, user string, realm string, tokenId string, comment string, expire int64, privsep bool) (*proxmoxToken, error) {
 	if len(user) == 0 {
 		return nil, errors.New("error creating token: no user provided")
 	}
@@ -112,36 +372,207 @@ func createToken(ctx context.Context, c *proxmoxClient, user string, realm strin
 		return nil, errors.New("error creating token: no realm provided")
 	}
 
-	rawTokenId := uuid.New().String()
-	// Proxmox API wants token IDs to start with a latter (regexp (?^:[A-Za-z][A-Za-z0-9\.\-_]+)) so lets remap the entire thing
-	tokenId := strings.NewReplacer("0", "g", "1", "h", "2", "i", "3", "j", "4", "k", "5", "l", "6", "m", "7", "n", "8", "o", "9", "p").Replace(rawTokenId)
+	if len(tokenId) == 0 {
+		return nil, errors.New("error creating token: no token provided")
+	}
 
-	u, err := pxapi.NewConfigUserFromApi(pxapi.UserID{Name: user, Realm: realm}, c.Client)
-	if err != nil {
-		return nil, fmt.Errorf("error when setting up API user: %w", err)
+	var result struct {
+		Value string `json:"value"`
 	}
 
-	secret, err := u.CreateApiToken(c.Client, pxapi.ApiToken{TokenId: tokenId, Comment: "Managed by Vault", Expire: expire, Privsep: privsep})
+	err := c.post(ctx, userPath(user, realm, "token", tokenId), neturl.Values{
+		"comment": {comment},
+		"expire":  {strconv.FormatInt(expire, 10)},
+		"privsep": {boolParam(privsep)},
+	}, &result)
 	if err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			return nil, fmt.Errorf("error from API when creating token: %w: %w", errTokenExists, err)
+		}
 		return nil, fmt.Errorf("error from API when creating token: %w", err)
 	}
 
+	if result.Value == "" {
+		return nil, errors.New("error creating token: no secret returned")
+	}
+
 	return &proxmoxToken{
 		TokenID: tokenId,
-		Secret:  secret,
+		Secret:  result.Value,
+		User:    user,
+		Realm:   realm,
 	}, nil
 }
 
-func deleteToken(ctx context.Context, c *proxmoxClient, user string, realm string, tokenID string) error {
-	u, err := pxapi.NewConfigUserFromApi(pxapi.UserID{Name: user, Realm: realm}, c.Client)
-	if err != nil {
-		return err
+type proxmoxTokenInfo struct {
+	TokenID string
+	Comment string
+	Expire  int64
+	Privsep bool
+}
+
+func tokenInfoFromAPI(tokenID string, data map[string]interface{}) *proxmoxTokenInfo {
+	info := &proxmoxTokenInfo{
+		TokenID: tokenID,
 	}
 
-	err = u.DeleteApiToken(c.Client, pxapi.ApiToken{TokenId: tokenID})
+	if id, ok := data["tokenid"].(string); ok {
+		info.TokenID = id
+	}
+	if comment, ok := data["comment"].(string); ok {
+		info.Comment = comment
+	}
+	if expire, ok := data["expire"].(float64); ok {
+		info.Expire = int64(expire)
+	}
+	if privsep, ok := data["privsep"].(float64); ok {
+		info.Privsep = privsep != 0
+	}
+
+	return info
+}
+
+func (c *httpClient) GetToken(ctx context.Context, user string, realm string, tokenID string) (*proxmoxTokenInfo, error) {
+	var data map[string]interface{}
+	if err := c.get(ctx, userPath(user, realm, "token", tokenID), nil, &data); err != nil {
+		return nil, fmt.Errorf("error from API when reading token: %w", err)
+	}
+
+	return tokenInfoFromAPI(tokenID, data), nil
+}
+
+// SetTokenExpire changes when Proxmox stops accepting a token, leaving everything else about it as is
+func (c *httpClient) SetTokenExpire(ctx context.Context, user string, realm string, tokenID string, expire int64) error {
+	if len(tokenID) == 0 {
+		return errors.New("error updating token: no token provided")
+	}
+
+	err := c.put(ctx, userPath(user, realm, "token", tokenID), neturl.Values{
+		"expire": {strconv.FormatInt(expire, 10)},
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("error from API when updating token: %w", err)
+	}
+
+	return nil
+}
+
+// ListTokens returns all tokens of a user
+func (c *httpClient) ListTokens(ctx context.Context, user string, realm string) ([]*proxmoxTokenInfo, error) {
+	var entries []interface{}
+	if err := c.get(ctx, userPath(user, realm, "token"), nil, &entries); err != nil {
+		return nil, fmt.Errorf("error from API when listing tokens: %w", err)
+	}
+
+	tokens := make([]*proxmoxTokenInfo, 0, len(entries))
+	for _, entryRaw := range entries {
+		entry, ok := entryRaw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tokens = append(tokens, tokenInfoFromAPI("", entry))
+	}
+
+	return tokens, nil
+}
+
+func (c *httpClient) DeleteToken(ctx context.Context, user string, realm string, tokenID string) error {
+	if err := c.delete(ctx, userPath(user, realm, "token", tokenID)); err != nil {
+		return fmt.Errorf("error from API when deleting token: %w", err)
+	}
+
+	return nil
+}
+
+// revokeToken removes a token and everything created for it, deleting the whole user for ephemeral users.
+// Tokens deleted in Proxmox already, by hand or because they expired, count as revoked. With verify set it
+// checks that the token is gone afterwards.
+func (b *proxmoxBackend) revokeToken(ctx context.Context, c proxmoxClient, token *proxmoxToken, verify bool) error {
+	if token.EphemeralUser {
+		if err := b.deleteUser(ctx, c, token.User, token.Realm); err != nil {
+			return err
+		}
+	} else {
+		if err := b.deleteToken(ctx, c, token.User, token.Realm, token.TokenID); err != nil {
+			return err
+		}
+	}
+
+	if verify {
+		if err := verifyTokenRevoked(ctx, c, token); err != nil {
+			return err
+		}
+	}
+
+	if token.PrivilegeRole != "" {
+		err := c.DeleteRole(ctx, token.PrivilegeRole)
+		if errors.Is(err, errNotFound) {
+			b.Logger().Info("role was already deleted in Proxmox", "role", token.PrivilegeRole)
+		} else if err != nil {
+			return fmt.Errorf("error deleting role: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// deleteToken deletes a token, one that is already gone from Proxmox counts as deleted
+func (b *proxmoxBackend) deleteToken(ctx context.Context, c proxmoxClient, user string, realm string, tokenID string) error {
+	err := c.DeleteToken(ctx, user, realm, tokenID)
+	if errors.Is(err, errNotFound) {
+		b.Logger().Info("token was already deleted in Proxmox", "user", user, "realm", realm, "token_id", tokenID)
+		return nil
 	}
+	return err
+}
 
+// deleteUser deletes a user, one that is already gone from Proxmox counts as deleted
+func (b *proxmoxBackend) deleteUser(ctx context.Context, c proxmoxClient, user string, realm string) error {
+	err := c.DeleteUser(ctx, user, realm)
+	if errors.Is(err, errNotFound) {
+		b.Logger().Info("user was already deleted in Proxmox", "user", user, "realm", realm)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error deleting user: %w", err)
+	}
 	return nil
 }
+
+// verifyTokenRevoked checks that Proxmox no longer knows a token, or the user of an ephemeral one
+func verifyTokenRevoked(ctx context.Context, c proxmoxClient, token *proxmoxToken) error {
+	if token.EphemeralUser {
+		exists, err := c.UserExists(ctx, token.User, token.Realm)
+		if err != nil {
+			return fmt.Errorf("error verifying user was deleted: %w", err)
+		}
+		if exists {
+			return fmt.Errorf("user %s still exists after deleting it", formatUserID(token.User, token.Realm))
+		}
+		return nil
+	}
+
+	_, err := c.GetToken(ctx, token.User, token.Realm, token.TokenID)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error verifying token was deleted: %w", err)
+	}
+
+	return fmt.Errorf("token %s!%s still exists after deleting it", formatUserID(token.User, token.Realm), token.TokenID)
+}
+
+// verifyRevocation reports whether revocations on a connection are to be checked, see verifyTokenRevoked
+func (b *proxmoxBackend) verifyRevocation(ctx context.Context, s logical.Storage, connection string) (bool, error) {
+	if connection == "" {
+		connection = defaultConnectionName
+	}
+
+	config, err := getConfig(ctx, s, connection)
+	if err != nil {
+		return false, err
+	}
+
+	return config != nil && config.VerifyRevocation, nil
+}
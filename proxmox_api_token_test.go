@@ -0,0 +1,324 @@
+package proxmox
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretOwner(t *testing.T) {
+	b, s, _ := getTestBackend(t)
+
+	resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"user":  "role-user",
+		"realm": "pve",
+	})
+	require.Nil(t, err)
+	require.Nil(t, resp)
+
+	secretOwner := func(internalData map[string]interface{}, indexEntry *tokenIndexEntry) (string, string, string, error) {
+		return b.secretOwner(context.Background(), &logical.Request{
+			Storage: s,
+			Secret:  &logical.Secret{InternalData: internalData},
+		}, indexEntry)
+	}
+
+	t.Run("Stored User ID", func(t *testing.T) {
+		user, realm, connection, err := secretOwner(map[string]interface{}{
+			"role":       roleName,
+			"user_id":    "ci@example.com@pve",
+			"connection": "other",
+		}, nil)
+
+		require.NoError(t, err)
+		require.Equal(t, "ci@example.com", user)
+		require.Equal(t, "pve", realm)
+		require.Equal(t, "other", connection)
+	})
+
+	t.Run("Invalid User ID", func(t *testing.T) {
+		_, _, _, err := secretOwner(map[string]interface{}{
+			"user_id": "ci",
+		}, nil)
+
+		require.Error(t, err)
+	})
+
+	t.Run("Fallback To Index", func(t *testing.T) {
+		user, realm, connection, err := secretOwner(map[string]interface{}{
+			"role": roleName,
+		}, &tokenIndexEntry{User: "index-user", Realm: "pam", Connection: "other"})
+
+		require.NoError(t, err)
+		require.Equal(t, "index-user", user)
+		require.Equal(t, "pam", realm)
+		require.Equal(t, "other", connection)
+	})
+
+	t.Run("Fallback To Role", func(t *testing.T) {
+		user, realm, connection, err := secretOwner(map[string]interface{}{
+			"role": roleName,
+		}, nil)
+
+		require.NoError(t, err)
+		require.Equal(t, "role-user", user)
+		require.Equal(t, "pve", realm)
+		require.Equal(t, defaultConnectionName, connection)
+	})
+
+	t.Run("Fallback Without Role", func(t *testing.T) {
+		_, _, _, err := secretOwner(map[string]interface{}{
+			"role": "missing",
+		}, nil)
+
+		require.Error(t, err)
+	})
+}
+
+func TestRenderTokenID(t *testing.T) {
+	t.Run("Random Without Template", func(t *testing.T) {
+		tokenID, err := renderTokenID("", roleName, "token")
+
+		require.NoError(t, err)
+		require.NoError(t, validateTokenID(tokenID))
+	})
+
+	t.Run("Template", func(t *testing.T) {
+		tokenID, err := renderTokenID("{{ .RoleName }}-{{ .DisplayName }}-{{ unix_time }}-{{ random 6 }}", "ci", "approle")
+
+		require.NoError(t, err)
+		require.Regexp(t, regexp.MustCompile(`^ci-approle-[0-9]+-[A-Za-z0-9]{6}$`), tokenID)
+	})
+
+	t.Run("Fresh Randomness", func(t *testing.T) {
+		first, err := renderTokenID("{{ .RoleName }}-{{ random 20 }}", "ci", "token")
+		require.NoError(t, err)
+
+		second, err := renderTokenID("{{ .RoleName }}-{{ random 20 }}", "ci", "token")
+		require.NoError(t, err)
+
+		require.NotEqual(t, first, second)
+	})
+
+	t.Run("Display Name Is Sanitized", func(t *testing.T) {
+		tokenID, err := renderTokenID("{{ .DisplayName }}", "ci", "oidc-jane@example.com")
+
+		require.NoError(t, err)
+		require.Equal(t, "oidc-jane-example.com", tokenID)
+	})
+
+	t.Run("Invalid Character", func(t *testing.T) {
+		_, err := renderTokenID("{{ .RoleName }}@corp", "ci", "token")
+
+		require.Error(t, err)
+	})
+
+	t.Run("Too Long", func(t *testing.T) {
+		_, err := renderTokenID("{{ .RoleName }}", strings.Repeat("a", maxTokenIDLength+1), "token")
+
+		require.Error(t, err)
+	})
+}
+
+func TestRenderTokenComment(t *testing.T) {
+	data := tokenCommentTemplateData{
+		EntityID:      "7d2e3a4c-0000-0000-0000-000000000000",
+		DisplayName:   "approle",
+		RequestID:     "5b1c9f2e-0000-0000-0000-000000000000",
+		RoleName:      "ci",
+		MountAccessor: "proxmox_1234abcd",
+	}
+
+	t.Run("Default Without Template", func(t *testing.T) {
+		comment, err := renderTokenComment("", data)
+
+		require.NoError(t, err)
+		require.Equal(t, vaultComment, comment)
+	})
+
+	t.Run("Template", func(t *testing.T) {
+		comment, err := renderTokenComment("{{ .RoleName }} on {{ .MountAccessor }} for entity {{ .EntityID }} ({{ .DisplayName }}), request {{ .RequestID }}", data)
+
+		require.NoError(t, err)
+		require.Equal(t, vaultComment+": ci on proxmox_1234abcd for entity 7d2e3a4c-0000-0000-0000-000000000000 (approle), request 5b1c9f2e-0000-0000-0000-000000000000", comment)
+	})
+
+	t.Run("Empty Rendering", func(t *testing.T) {
+		comment, err := renderTokenComment("{{ .EntityID }}", tokenCommentTemplateData{})
+
+		require.NoError(t, err)
+		require.Equal(t, vaultComment, comment)
+	})
+
+	t.Run("Multiple Lines", func(t *testing.T) {
+		_, err := renderTokenComment("{{ .RoleName }}\n{{ .EntityID }}", data)
+
+		require.Error(t, err)
+	})
+}
+
+func TestTokenRenew(t *testing.T) {
+	b, s, fake := getTestBackend(t)
+
+	resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"user":    testUser,
+		"realm":   testRealm,
+		"ttl":     "1h",
+		"max_ttl": "3h",
+	})
+	require.Nil(t, err)
+	require.Nil(t, resp)
+
+	testFakeConnection(t, b, s, defaultConnectionName, fake)
+
+	roleUserID := formatUserID(testUser, testRealm)
+	ephemeralUserID := formatUserID("vault-ci-0123456789ab", testRealm)
+	fake.addUser(roleUserID)
+	fake.addToken(roleUserID, "abc-def")
+	fake.addUser(ephemeralUserID)
+	fake.addToken(ephemeralUserID, "ghi-jkl")
+
+	issued := time.Now()
+	require.NoError(t, putTokenIndexEntry(context.Background(), s, &tokenIndexEntry{
+		TokenID:    "abc-def",
+		User:       testUser,
+		Realm:      testRealm,
+		Connection: defaultConnectionName,
+		Role:       roleName,
+		CreatedAt:  issued,
+		Expire:     issued.Add(time.Hour).Unix(),
+	}))
+
+	renew := func(increment time.Duration, internalData map[string]interface{}) (*logical.Response, error) {
+		secret := &logical.Secret{InternalData: internalData}
+		secret.IssueTime = issued
+		secret.Increment = increment
+
+		return b.tokenRenew(context.Background(), &logical.Request{
+			Storage: s,
+			Secret:  secret,
+		}, nil)
+	}
+
+	t.Run("Extend Token", func(t *testing.T) {
+		resp, err := renew(0, map[string]interface{}{
+			"token_id": "abc-def",
+			"role":     roleName,
+			"user_id":  roleUserID,
+			"indexed":  true,
+		})
+
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, time.Hour, resp.Secret.TTL)
+		require.Equal(t, 3*time.Hour, resp.Secret.MaxTTL)
+
+		expire := fake.token(roleUserID, "abc-def").Expire
+		require.InDelta(t, time.Now().Add(time.Hour+defaultTokenExpiryGrace).Unix(), expire, 5)
+
+		entry, err := getTokenIndexEntry(context.Background(), s, "abc-def")
+		require.NoError(t, err)
+		require.Equal(t, expire, entry.Expire)
+	})
+
+	t.Run("Honor Increment Within Max TTL", func(t *testing.T) {
+		resp, err := renew(24*time.Hour, map[string]interface{}{
+			"token_id": "abc-def",
+			"role":     roleName,
+			"user_id":  roleUserID,
+			"indexed":  true,
+		})
+
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.NotEmpty(t, resp.Warnings)
+		require.InDelta(t, 3*time.Hour, resp.Secret.TTL, float64(5*time.Second))
+
+		expire := fake.token(roleUserID, "abc-def").Expire
+		require.InDelta(t, issued.Add(3*time.Hour+defaultTokenExpiryGrace).Unix(), expire, 5)
+	})
+
+	t.Run("Extend Ephemeral User", func(t *testing.T) {
+		resp, err := renew(30*time.Minute, map[string]interface{}{
+			"token_id":       "ghi-jkl",
+			"role":           roleName,
+			"user":           "vault-ci-0123456789ab",
+			"realm":          testRealm,
+			"ephemeral_user": true,
+		})
+
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		tokenExpire := fake.token(ephemeralUserID, "ghi-jkl").Expire
+		require.InDelta(t, time.Now().Add(30*time.Minute+defaultTokenExpiryGrace).Unix(), tokenExpire, 5)
+		require.Equal(t, tokenExpire, fake.user(ephemeralUserID).Expire)
+	})
+}
+
+func TestTokenExpire(t *testing.T) {
+	b, s, _ := getTestBackend(t)
+	now := time.Now()
+
+	t.Run("Default Grace Without Config", func(t *testing.T) {
+		expire, err := tokenExpire(context.Background(), s, defaultConnectionName, now, time.Hour)
+
+		require.NoError(t, err)
+		require.Equal(t, now.Add(time.Hour+defaultTokenExpiryGrace).Unix(), expire)
+	})
+
+	t.Run("Configured Grace", func(t *testing.T) {
+		err := testConfigCreate(t, b, s, map[string]interface{}{
+			"user":               user,
+			"realm":              realm,
+			"token_id":           token_id,
+			"token_secret":       token_secret,
+			"proxmox_url":        url,
+			"token_expiry_grace": "1h",
+			"verify_connection":  false,
+		})
+		require.NoError(t, err)
+
+		expire, err := tokenExpire(context.Background(), s, defaultConnectionName, now, time.Hour)
+
+		require.NoError(t, err)
+		require.Equal(t, now.Add(2*time.Hour).Unix(), expire)
+	})
+
+	t.Run("Default Grace For Config Stored Before It Existed", func(t *testing.T) {
+		config, err := getConfig(context.Background(), s, defaultConnectionName)
+		require.NoError(t, err)
+
+		config.TokenExpiryGrace = nil
+		require.NoError(t, putConfig(context.Background(), s, defaultConnectionName, config))
+
+		expire, err := tokenExpire(context.Background(), s, defaultConnectionName, now, time.Hour)
+
+		require.NoError(t, err)
+		require.Equal(t, now.Add(time.Hour+defaultTokenExpiryGrace).Unix(), expire)
+	})
+
+	t.Run("Zero Grace", func(t *testing.T) {
+		err := testConfigUpdate(t, b, s, map[string]interface{}{
+			"token_expiry_grace": 0,
+			"verify_connection":  false,
+		})
+		require.NoError(t, err)
+
+		expire, err := tokenExpire(context.Background(), s, defaultConnectionName, now, time.Hour)
+
+		require.NoError(t, err)
+		require.Equal(t, now.Add(time.Hour).Unix(), expire)
+	})
+
+	t.Run("Never Without TTL", func(t *testing.T) {
+		_, err := tokenExpire(context.Background(), s, defaultConnectionName, now, 0)
+
+		require.Error(t, err)
+	})
+}
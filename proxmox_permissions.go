@@ -0,0 +1,118 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"strings"
+)
+
+// proxmoxPrivilege is a privilege the configured token needs on a path
+type proxmoxPrivilege struct {
+	Path      string
+	Privilege string
+}
+
+// requiredPrivileges are needed by the configured token to manage tokens and to grant them ACLs on any path,
+// roles using more than that are checked for rolePrivileges when they are written
+var requiredPrivileges = []proxmoxPrivilege{
+	{Path: "/access", Privilege: "User.Modify"},
+	{Path: "/", Privilege: "Permissions.Modify"},
+}
+
+// rolePrivileges returns what the configured token needs on top of requiredPrivileges for the leases of a role
+func rolePrivileges(role *proxmoxRoleEntry) []proxmoxPrivilege {
+	var privileges []proxmoxPrivilege
+
+	if role.EphemeralUser {
+		privileges = append(privileges, proxmoxPrivilege{Path: "/access/realm/" + role.Realm, Privilege: "Realm.AllocateUser"})
+	}
+
+	// every lease gets a Proxmox role of its own
+	if len(role.Privileges) > 0 {
+		privileges = append(privileges, proxmoxPrivilege{Path: "/access", Privilege: "Sys.Modify"})
+	}
+
+	return privileges
+}
+
+func (c *httpClient) Version(ctx context.Context) (string, error) {
+	var data map[string]interface{}
+	if err := c.get(ctx, "/version", nil, &data); err != nil {
+		return "", fmt.Errorf("error from API when reading version: %w", err)
+	}
+
+	version, ok := data["version"].(string)
+	if !ok {
+		return "", errors.New("error reading version: no version returned")
+	}
+
+	return version, nil
+}
+
+// Permissions returns the privileges the configured token has on a path
+func (c *httpClient) Permissions(ctx context.Context, path string) (map[string]bool, error) {
+	var data map[string]interface{}
+	if err := c.get(ctx, "/access/permissions", neturl.Values{"path": {path}}, &data); err != nil {
+		return nil, fmt.Errorf("error from API when reading permissions on path '%s': %w", path, err)
+	}
+
+	privileges := make(map[string]bool)
+
+	pathPrivileges, ok := data[path].(map[string]interface{})
+	if !ok {
+		return privileges, nil
+	}
+
+	for privilege, value := range pathPrivileges {
+		if granted, ok := value.(float64); ok && granted != 0 {
+			privileges[privilege] = true
+		}
+	}
+
+	return privileges, nil
+}
+
+// verifyConnection checks that the Proxmox API can be reached with the configured token and that the token
+// has all required privileges, naming every missing privilege in the error
+func verifyConnection(ctx context.Context, c proxmoxClient) error {
+	if _, err := c.Version(ctx); err != nil {
+		return err
+	}
+
+	missing, err := missingPrivileges(ctx, c, requiredPrivileges)
+	if err != nil {
+		return err
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("token is missing privileges: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// missingPrivileges returns the privileges the configured token lacks, each with the path it is needed on
+func missingPrivileges(ctx context.Context, c proxmoxClient, required []proxmoxPrivilege) ([]string, error) {
+	permissions := make(map[string]map[string]bool)
+
+	var missing []string
+	for _, r := range required {
+		privileges, ok := permissions[r.Path]
+		if !ok {
+			var err error
+			privileges, err = c.Permissions(ctx, r.Path)
+			if err != nil {
+				return nil, err
+			}
+			permissions[r.Path] = privileges
+		}
+
+		if !privileges[r.Privilege] {
+			missing = append(missing, fmt.Sprintf("%s on path '%s'", r.Privilege, r.Path))
+		}
+	}
+
+	return missing, nil
+}
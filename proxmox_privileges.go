@@ -0,0 +1,73 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	privilegeRolePrefix = "vault-"
+)
+
+var privilegeRegex = regexp.MustCompile(`^[A-Za-z]+(\.[A-Za-z]+)+$`)
+
+func validatePrivileges(privileges []string) error {
+	for _, privilege := range privileges {
+		if !privilegeRegex.MatchString(privilege) {
+			return fmt.Errorf("invalid privilege %q, expected something like VM.Allocate", privilege)
+		}
+	}
+	return nil
+}
+
+// privilegeRoleID returns the ID of the temporary Proxmox role backing a token
+func privilegeRoleID(tokenID string) string {
+	return privilegeRolePrefix + tokenID
+}
+
+func (c *httpClient) CreateRole(ctx context.Context, roleID string, privileges []string) error {
+	if len(roleID) == 0 {
+		return errors.New("error creating role: no role provided")
+	}
+
+	if len(privileges) == 0 {
+		return errors.New("error creating role: no privileges provided")
+	}
+
+	err := c.post(ctx, "/access/roles", neturl.Values{
+		"roleid": {roleID},
+		"privs":  {strings.Join(privileges, ",")},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error from API when creating role: %w", err)
+	}
+
+	return nil
+}
+
+func (c *httpClient) DeleteRole(ctx context.Context, roleID string) error {
+	if err := c.delete(ctx, "/access/roles/"+neturl.PathEscape(roleID)); err != nil {
+		return fmt.Errorf("error from API when deleting role: %w", err)
+	}
+
+	return nil
+}
+
+func (c *httpClient) RoleExists(ctx context.Context, roleID string) (bool, error) {
+	var roles []interface{}
+	if err := c.get(ctx, "/access/roles", nil, &roles); err != nil {
+		return false, fmt.Errorf("error from API when listing roles: %w", err)
+	}
+
+	for _, roleRaw := range roles {
+		if role, ok := roleRaw.(map[string]interface{}); ok && role["roleid"] == roleID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,124 @@
+package proxmox
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	neturl "net/url"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	proxmoxTicketType = "proxmox_ticket"
+
+	// Proxmox auth tickets are valid for two hours, this can't be changed
+	ticketLifetime = 2 * time.Hour
+
+	passwordLength  = 32
+	passwordCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+type proxmoxTicket struct {
+	Username            string `json:"username"`
+	Ticket              string `json:"ticket"`
+	CSRFPreventionToken string `json:"CSRFPreventionToken"`
+}
+
+func (b *proxmoxBackend) proxmoxTicket() *framework.Secret {
+	return &framework.Secret{
+		Type: proxmoxTicketType,
+		Fields: map[string]*framework.FieldSchema{
+			"username": {
+				Type:        framework.TypeString,
+				Description: "The user the ticket was issued for, as <user>@<realm>",
+			},
+			"ticket": {
+				Type:        framework.TypeString,
+				Description: "The auth ticket, sent as the PVEAuthCookie cookie",
+			},
+			"csrf_prevention_token": {
+				Type:        framework.TypeString,
+				Description: "The CSRFPreventionToken header required on write requests",
+			},
+			"expires_at": {
+				Type:        framework.TypeString,
+				Description: "When Proxmox stops accepting the ticket",
+			},
+		},
+		Revoke: b.ticketRevoke,
+	}
+}
+
+func (b *proxmoxBackend) ticketRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	// leases issued before named connections existed were all issued on the default connection
+	connection, _ := req.Secret.InternalData["connection"].(string)
+
+	client, err := b.getClient(ctx, req.Storage, connection)
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %w", err)
+	}
+
+	user, realm, _, err := b.secretOwner(ctx, req, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if ephemeralUser, _ := req.Secret.InternalData["ephemeral_user"].(bool); ephemeralUser {
+		err := client.DeleteUser(ctx, user, realm)
+		if errors.Is(err, errNotFound) {
+			b.Logger().Info("ticket user was already deleted in Proxmox", "user", user, "realm", realm)
+		} else if err != nil {
+			return nil, fmt.Errorf("error deleting ticket user: %w", err)
+		}
+		return nil, nil
+	}
+
+	// the password handed to Proxmox for this lease is never stored, replace it with one nobody knows
+	password, err := generatePassword()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.SetUserPassword(ctx, user, realm, password); err != nil {
+		return nil, fmt.Errorf("error invalidating ticket user password: %w", err)
+	}
+
+	return nil, nil
+}
+
+func generatePassword() (string, error) {
+	charsetLen := big.NewInt(int64(len(passwordCharset)))
+	password := make([]byte, passwordLength)
+
+	for i := range password {
+		n, err := rand.Int(rand.Reader, charsetLen)
+		if err != nil {
+			return "", fmt.Errorf("error generating password: %w", err)
+		}
+		password[i] = passwordCharset[n.Int64()]
+	}
+
+	return string(password), nil
+}
+
+func (c *httpClient) CreateTicket(ctx context.Context, user string, realm string, password string) (*proxmoxTicket, error) {
+	var ticket proxmoxTicket
+	err := c.post(ctx, "/access/ticket", neturl.Values{
+		"username": {formatUserID(user, realm)},
+		"password": {password},
+	}, &ticket)
+	if err != nil {
+		return nil, fmt.Errorf("error from API when creating ticket: %w", err)
+	}
+
+	if ticket.Ticket == "" {
+		return nil, errors.New("error creating ticket: no ticket returned")
+	}
+
+	return &ticket, nil
+}
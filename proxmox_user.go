@@ -0,0 +1,163 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ephemeralUserPrefix        = "vault-"
+	ephemeralUserMaxRoleLength = 32
+)
+
+// ephemeralUserName generates a unique user name for a lease of the given role
+func ephemeralUserName(roleName string) string {
+	if len(roleName) > ephemeralUserMaxRoleLength {
+		roleName = roleName[:ephemeralUserMaxRoleLength]
+	}
+
+	suffix := strings.ReplaceAll(uuid.New().String(), "-", "")[:12]
+
+	return fmt.Sprintf("%s%s-%s", ephemeralUserPrefix, roleName, suffix)
+}
+
+// formatUserID returns the full Proxmox user ID, <user>@<realm>
+func formatUserID(user string, realm string) string {
+	return user + "@" + realm
+}
+
+// splitUserID splits a full Proxmox user ID into user and realm, user names may contain '@' but realms can't
+func splitUserID(userID string) (string, string, error) {
+	i := strings.LastIndex(userID, "@")
+	if i <= 0 || i == len(userID)-1 {
+		return "", "", fmt.Errorf("invalid user ID %q, expected <user>@<realm>", userID)
+	}
+	return userID[:i], userID[i+1:], nil
+}
+
+// proxmoxUserInfo is what Proxmox reports about a user
+type proxmoxUserInfo struct {
+	Enabled bool
+	Expire  int64
+}
+
+// GetUser returns a user, or nil if it doesn't exist
+func (c *httpClient) GetUser(ctx context.Context, user string, realm string) (*proxmoxUserInfo, error) {
+	var users []interface{}
+	if err := c.get(ctx, "/access/users", nil, &users); err != nil {
+		return nil, fmt.Errorf("error from API when listing users: %w", err)
+	}
+
+	userID := formatUserID(user, realm)
+
+	for _, entryRaw := range users {
+		entry, ok := entryRaw.(map[string]interface{})
+		if !ok || entry["userid"] != userID {
+			continue
+		}
+
+		// users without an explicit enable flag are enabled
+		info := &proxmoxUserInfo{Enabled: true}
+		if enable, ok := entry["enable"].(float64); ok {
+			info.Enabled = enable != 0
+		}
+		if expire, ok := entry["expire"].(float64); ok {
+			info.Expire = int64(expire)
+		}
+
+		return info, nil
+	}
+
+	return nil, nil
+}
+
+func (c *httpClient) RealmExists(ctx context.Context, realm string) (bool, error) {
+	var domains []interface{}
+	if err := c.get(ctx, "/access/domains", nil, &domains); err != nil {
+		return false, fmt.Errorf("error from API when listing realms: %w", err)
+	}
+
+	for _, entryRaw := range domains {
+		if entry, ok := entryRaw.(map[string]interface{}); ok && entry["realm"] == realm {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (c *httpClient) CreateUser(ctx context.Context, user string, realm string, password string, groups []string, expire int64) error {
+	if len(user) == 0 {
+		return errors.New("error creating user: no user provided")
+	}
+
+	if len(realm) == 0 {
+		return errors.New("error creating user: no realm provided")
+	}
+
+	params := neturl.Values{
+		"userid":  {formatUserID(user, realm)},
+		"comment": {vaultComment},
+		"enable":  {"1"},
+		"expire":  {strconv.FormatInt(expire, 10)},
+	}
+	if len(groups) > 0 {
+		params.Set("groups", strings.Join(groups, ","))
+	}
+	if password != "" {
+		params.Set("password", password)
+	}
+
+	if err := c.post(ctx, "/access/users", params, nil); err != nil {
+		return fmt.Errorf("error from API when creating user: %w", err)
+	}
+
+	return nil
+}
+
+func (c *httpClient) DeleteUser(ctx context.Context, user string, realm string) error {
+	if err := c.delete(ctx, userPath(user, realm)); err != nil {
+		return fmt.Errorf("error from API when deleting user: %w", err)
+	}
+
+	return nil
+}
+
+func (c *httpClient) UserExists(ctx context.Context, user string, realm string) (bool, error) {
+	info, err := c.GetUser(ctx, user, realm)
+	if err != nil {
+		return false, err
+	}
+
+	return info != nil, nil
+}
+
+// SetUserExpire changes when Proxmox disables a user, leaving everything else about it as is
+func (c *httpClient) SetUserExpire(ctx context.Context, user string, realm string, expire int64) error {
+	err := c.put(ctx, userPath(user, realm), neturl.Values{
+		"expire": {strconv.FormatInt(expire, 10)},
+	})
+	if err != nil {
+		return fmt.Errorf("error from API when updating user: %w", err)
+	}
+
+	return nil
+}
+
+func (c *httpClient) SetUserPassword(ctx context.Context, user string, realm string, password string) error {
+	err := c.put(ctx, "/access/password", neturl.Values{
+		"userid":   {formatUserID(user, realm)},
+		"password": {password},
+	})
+	if err != nil {
+		return fmt.Errorf("error from API when setting user password: %w", err)
+	}
+
+	return nil
+}
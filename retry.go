@@ -0,0 +1,114 @@
+package proxmox
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultMaxAttempts rides out a pveproxy restart, which takes a few seconds
+	defaultMaxAttempts = 4
+
+	defaultRetryDelay = 500 * time.Millisecond
+	maxRetryDelay     = 8 * time.Second
+)
+
+// permanentServerErrors are messages of 500 responses that won't change by trying again
+var permanentServerErrors = []string{
+	"already exists",
+	"no such",
+	"does not exist",
+}
+
+// transientServerErrors are messages of 500 responses where Proxmox gave up before changing anything,
+// mostly failing to lock the cluster filesystem
+var transientServerErrors = []string{
+	"cfs-lock",
+	"lock request timeout",
+	"cluster not ready",
+}
+
+// retryable reports whether a failed request can be tried again. Requests reading something or setting it
+// to a given value are retried on server errors and broken connections. POST requests create things, a
+// second attempt fails if the first one got through, so they are only retried when Proxmox can't have
+// acted on them.
+func retryable(method string, err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return retryableStatus(method, apiErr)
+	}
+
+	// the connection couldn't even be opened, nothing was sent
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	if method == http.MethodPost {
+		return false
+	}
+
+	// a request running into the timeout already took long enough
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return !netErr.Timeout()
+	}
+
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func retryableStatus(method string, err *apiError) bool {
+	// 4xx are problems with the request itself, like failing parameter validation
+	if err.StatusCode < 500 {
+		return false
+	}
+
+	message := strings.ToLower(err.Message)
+
+	for _, permanent := range permanentServerErrors {
+		if strings.Contains(message, permanent) {
+			return false
+		}
+	}
+
+	if err.StatusCode == http.StatusServiceUnavailable {
+		return true
+	}
+
+	for _, transient := range transientServerErrors {
+		if strings.Contains(message, transient) {
+			return true
+		}
+	}
+
+	return method != http.MethodPost && err.StatusCode != http.StatusNotImplemented
+}
+
+// retryBackoff returns how long to wait before the next attempt, doubling with every attempt and
+// jittered so clients failing at the same time don't all come back at once
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
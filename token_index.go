@@ -0,0 +1,152 @@
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	tokenIndexStoragePrefix = "token/"
+
+	// roleTokenIndexStoragePrefix holds an empty entry per token under the role it was issued for
+	roleTokenIndexStoragePrefix = "role-tokens/"
+)
+
+// tokenIndexEntry records a token issued for a lease for as long as the lease exists
+type tokenIndexEntry struct {
+	TokenID    string    `json:"token_id"`
+	User       string    `json:"user"`
+	Realm      string    `json:"realm"`
+	Connection string    `json:"connection"`
+	Role       string    `json:"role"`
+	EntityID   string    `json:"entity_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	Expire     int64     `json:"expire"`
+
+	EphemeralUser bool   `json:"ephemeral_user"`
+	PrivilegeRole string `json:"privilege_role"`
+}
+
+// belongsTo reports whether an entry is for the token of a user on a connection, token IDs are only unique per user
+func (e *tokenIndexEntry) belongsTo(connection string, user string, realm string) bool {
+	return e.Connection == connection && e.User == user && e.Realm == realm
+}
+
+func (e *tokenIndexEntry) toResponseData() map[string]interface{} {
+	expiresAt := ""
+	if e.Expire > 0 {
+		expiresAt = time.Unix(e.Expire, 0).UTC().Format(time.RFC3339)
+	}
+
+	return map[string]interface{}{
+		"token_id":      e.TokenID,
+		"token_id_full": fmt.Sprintf("%s@%s!%s", e.User, e.Realm, e.TokenID),
+		"user":          e.User,
+		"realm":         e.Realm,
+		"connection":    e.Connection,
+		"role":          e.Role,
+		"entity_id":     e.EntityID,
+		"created_at":    e.CreatedAt.UTC().Format(time.RFC3339),
+		"expires_at":    expiresAt,
+	}
+}
+
+func putTokenIndexEntry(ctx context.Context, s logical.Storage, entry *tokenIndexEntry) error {
+	storageEntry, err := logical.StorageEntryJSON(tokenIndexStoragePrefix+entry.TokenID, entry)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Put(ctx, storageEntry); err != nil {
+		return fmt.Errorf("error storing token index entry: %w", err)
+	}
+
+	if entry.Role != "" {
+		err := s.Put(ctx, &logical.StorageEntry{Key: roleTokenIndexStoragePrefix + entry.Role + "/" + entry.TokenID})
+		if err != nil {
+			return fmt.Errorf("error storing token index entry: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func getTokenIndexEntry(ctx context.Context, s logical.Storage, tokenID string) (*tokenIndexEntry, error) {
+	storageEntry, err := s.Get(ctx, tokenIndexStoragePrefix+tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	if storageEntry == nil {
+		return nil, nil
+	}
+
+	entry := new(tokenIndexEntry)
+	if err := storageEntry.DecodeJSON(entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func deleteTokenIndexEntry(ctx context.Context, s logical.Storage, tokenID string) error {
+	if tokenID == "" {
+		return nil
+	}
+
+	entry, err := getTokenIndexEntry(ctx, s, tokenID)
+	if err != nil {
+		return err
+	}
+
+	if entry == nil {
+		return nil
+	}
+
+	if entry.Role != "" {
+		if err := s.Delete(ctx, roleTokenIndexStoragePrefix+entry.Role+"/"+tokenID); err != nil {
+			return fmt.Errorf("error deleting token index entry: %w", err)
+		}
+	}
+
+	if err := s.Delete(ctx, tokenIndexStoragePrefix+tokenID); err != nil {
+		return fmt.Errorf("error deleting token index entry: %w", err)
+	}
+
+	return nil
+}
+
+// revokeIndexedToken deletes a token and everything created for it in Proxmox, followed by its index entry
+func (b *proxmoxBackend) revokeIndexedToken(ctx context.Context, s logical.Storage, entry *tokenIndexEntry) error {
+	client, err := b.getClient(ctx, s, entry.Connection)
+	if err != nil {
+		return err
+	}
+
+	token := &proxmoxToken{
+		TokenID:       entry.TokenID,
+		User:          entry.User,
+		Realm:         entry.Realm,
+		EphemeralUser: entry.EphemeralUser,
+		PrivilegeRole: entry.PrivilegeRole,
+	}
+
+	verify, err := b.verifyRevocation(ctx, s, entry.Connection)
+	if err != nil {
+		return err
+	}
+
+	if err := b.revokeToken(ctx, client, token, verify); err != nil {
+		return fmt.Errorf("error revoking token %s@%s!%s: %w", entry.User, entry.Realm, entry.TokenID, err)
+	}
+
+	return deleteTokenIndexEntry(ctx, s, entry.TokenID)
+}
+
+// listRoleTokens returns the IDs of the tokens issued for a role that still belong to a lease
+func listRoleTokens(ctx context.Context, s logical.Storage, role string) ([]string, error) {
+	return s.List(ctx, roleTokenIndexStoragePrefix+role+"/")
+}
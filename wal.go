@@ -0,0 +1,127 @@
+package proxmox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	walTypeToken = "token"
+	walTypeUser  = "user"
+
+	// creating a token takes a handful of API calls, anything still around after this has leaked
+	walRollbackMinAge = 10 * time.Minute
+)
+
+// walToken records a token about to be created for a lease, so it can be removed again if the lease
+// is never handed out
+type walToken struct {
+	Connection    string `json:"connection" mapstructure:"connection"`
+	User          string `json:"user" mapstructure:"user"`
+	Realm         string `json:"realm" mapstructure:"realm"`
+	TokenID       string `json:"token_id" mapstructure:"token_id"`
+	EphemeralUser bool   `json:"ephemeral_user" mapstructure:"ephemeral_user"`
+	PrivilegeRole string `json:"privilege_role" mapstructure:"privilege_role"`
+}
+
+// walUser records an ephemeral user about to be created for a ticket lease, so it can be removed again if
+// the lease is never handed out
+type walUser struct {
+	Connection string `json:"connection" mapstructure:"connection"`
+	User       string `json:"user" mapstructure:"user"`
+	Realm      string `json:"realm" mapstructure:"realm"`
+}
+
+func (b *proxmoxBackend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	switch kind {
+	case walTypeToken:
+		return b.rollbackToken(ctx, req.Storage, data)
+	case walTypeUser:
+		return b.rollbackUser(ctx, req.Storage, data)
+	default:
+		return fmt.Errorf("unknown WAL entry type %q", kind)
+	}
+}
+
+// rollbackToken removes whatever was created for a token of a lease that never made it to Vault,
+// every step may or may not have happened before the request failed
+func (b *proxmoxBackend) rollbackToken(ctx context.Context, s logical.Storage, data interface{}) error {
+	var entry walToken
+	if err := mapstructure.Decode(data, &entry); err != nil {
+		return err
+	}
+
+	client, err := b.rollbackClient(ctx, s, entry.Connection)
+	if err != nil {
+		return err
+	}
+
+	if client != nil {
+		b.Logger().Info("rolling back leaked token", "user", entry.User, "realm", entry.Realm, "token_id", entry.TokenID)
+
+		token := &proxmoxToken{
+			TokenID:       entry.TokenID,
+			User:          entry.User,
+			Realm:         entry.Realm,
+			EphemeralUser: entry.EphemeralUser,
+			PrivilegeRole: entry.PrivilegeRole,
+		}
+
+		// anything already gone, down to the user of the token, counts as rolled back
+		if err := b.revokeToken(ctx, client, token, false); err != nil {
+			return fmt.Errorf("error deleting leaked token: %w", err)
+		}
+	}
+
+	indexEntry, err := getTokenIndexEntry(ctx, s, entry.TokenID)
+	if err != nil {
+		return err
+	}
+
+	// the ID may be indexed for the token of another user by now
+	if indexEntry == nil || !indexEntry.belongsTo(entry.Connection, entry.User, entry.Realm) {
+		return nil
+	}
+
+	return deleteTokenIndexEntry(ctx, s, entry.TokenID)
+}
+
+// rollbackUser removes the ephemeral user of a ticket lease that never made it to Vault
+func (b *proxmoxBackend) rollbackUser(ctx context.Context, s logical.Storage, data interface{}) error {
+	var entry walUser
+	if err := mapstructure.Decode(data, &entry); err != nil {
+		return err
+	}
+
+	client, err := b.rollbackClient(ctx, s, entry.Connection)
+	if err != nil || client == nil {
+		return err
+	}
+
+	b.Logger().Info("rolling back leaked user", "user", entry.User, "realm", entry.Realm)
+	if err := b.deleteUser(ctx, client, entry.User, entry.Realm); err != nil {
+		return fmt.Errorf("error deleting leaked user: %w", err)
+	}
+
+	return nil
+}
+
+// rollbackClient returns the client of the connection a WAL entry was written for, or nil if the connection
+// has been deleted since and there is nothing left to roll back on it
+func (b *proxmoxBackend) rollbackClient(ctx context.Context, s logical.Storage, connection string) (proxmoxClient, error) {
+	config, err := getConfig(ctx, s, connection)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		b.Logger().Info("connection is no longer configured, nothing to roll back", "connection", connection)
+		return nil, nil
+	}
+
+	return b.getClient(ctx, s, connection)
+}
@@ -0,0 +1,137 @@
+package proxmox
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenWAL(t *testing.T) {
+	b, s, fake := getTestBackend(t)
+
+	resp, err := testTokenRoleCreate(t, b, s, roleName, map[string]interface{}{
+		"user":  testUser,
+		"realm": testRealm,
+	})
+	require.Nil(t, err)
+	require.Nil(t, resp)
+
+	t.Run("Failed Creds Keep WAL Entry", func(t *testing.T) {
+		// nothing is configured, so creating the token fails after the WAL entry is written
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + roleName,
+			Storage:   s,
+		})
+		require.Error(t, err)
+
+		walIDs, err := framework.ListWAL(context.Background(), s)
+		require.NoError(t, err)
+		require.Len(t, walIDs, 1)
+
+		entry, err := framework.GetWAL(context.Background(), s, walIDs[0])
+		require.NoError(t, err)
+		require.Equal(t, walTypeToken, entry.Kind)
+
+		data := entry.Data.(map[string]interface{})
+		require.Equal(t, testUser, data["user"])
+		require.Equal(t, testRealm, data["realm"])
+		require.Equal(t, defaultConnectionName, data["connection"])
+		require.NotEmpty(t, data["token_id"])
+
+		// the token is indexed up front, but only the WAL entry outlives the failed request
+		indexEntry, err := getTokenIndexEntry(context.Background(), s, data["token_id"].(string))
+		require.NoError(t, err)
+		require.Nil(t, indexEntry)
+	})
+
+	t.Run("Nothing To Roll Back Without Connection", func(t *testing.T) {
+		walIDs, err := framework.ListWAL(context.Background(), s)
+		require.NoError(t, err)
+		require.Len(t, walIDs, 1)
+
+		entry, err := framework.GetWAL(context.Background(), s, walIDs[0])
+		require.NoError(t, err)
+
+		// the connection is gone, failing would only have the rollback retried forever
+		require.NoError(t, b.walRollback(context.Background(), &logical.Request{Storage: s}, entry.Kind, entry.Data))
+	})
+
+	t.Run("Nothing To Roll Back Without User", func(t *testing.T) {
+		testFakeConnection(t, b, s, defaultConnectionName, fake)
+
+		// a live lease on another user has a token with the same ID
+		require.NoError(t, putTokenIndexEntry(context.Background(), s, &tokenIndexEntry{
+			TokenID:    "leaked",
+			User:       "other",
+			Realm:      testRealm,
+			Connection: defaultConnectionName,
+		}))
+
+		for _, ephemeralUser := range []bool{false, true} {
+			err := b.walRollback(context.Background(), &logical.Request{Storage: s}, walTypeToken, map[string]interface{}{
+				"connection":     defaultConnectionName,
+				"user":           "deleted",
+				"realm":          testRealm,
+				"token_id":       "leaked",
+				"ephemeral_user": ephemeralUser,
+				"privilege_role": privilegeRoleID("leaked"),
+			})
+			require.NoError(t, err)
+		}
+
+		err := b.walRollback(context.Background(), &logical.Request{Storage: s}, walTypeUser, map[string]interface{}{
+			"connection": defaultConnectionName,
+			"user":       "deleted",
+			"realm":      testRealm,
+		})
+		require.NoError(t, err)
+
+		indexEntry, err := getTokenIndexEntry(context.Background(), s, "leaked")
+		require.NoError(t, err)
+		require.NotNil(t, indexEntry)
+	})
+
+	t.Run("Unknown WAL Kind", func(t *testing.T) {
+		err := b.walRollback(context.Background(), &logical.Request{Storage: s}, "unknown", nil)
+		require.Error(t, err)
+	})
+}
+
+func TestUserWAL(t *testing.T) {
+	b, s, fake := getTestBackend(t)
+	testFakeConnection(t, b, s, defaultConnectionName, fake)
+
+	resp, err := testTokenRoleCreate(t, b, s, "ticket", map[string]interface{}{
+		"realm":           "pve",
+		"ephemeral_user":  true,
+		"credential_type": "ticket",
+	})
+	require.Nil(t, err)
+	require.Nil(t, resp)
+
+	// creating the ticket fails, and so does deleting the user right away
+	fake.inject(fakeFault{Method: http.MethodPost, Path: "/access/ticket", Status: http.StatusUnauthorized, Reason: "authentication failure"})
+	fake.inject(fakeFault{Method: http.MethodDelete, Path: "/access/users/", Status: http.StatusBadRequest, Reason: "Parameter verification failed.", Times: 1})
+
+	_, err = testCredsRead(t, b, s, "ticket")
+	require.Error(t, err)
+
+	walIDs, err := framework.ListWAL(context.Background(), s)
+	require.NoError(t, err)
+	require.Len(t, walIDs, 1)
+
+	entry, err := framework.GetWAL(context.Background(), s, walIDs[0])
+	require.NoError(t, err)
+	require.Equal(t, walTypeUser, entry.Kind)
+
+	userID := formatUserID(entry.Data.(map[string]interface{})["user"].(string), "pve")
+	require.NotNil(t, fake.user(userID))
+
+	require.NoError(t, b.walRollback(context.Background(), &logical.Request{Storage: s}, entry.Kind, entry.Data))
+	require.Nil(t, fake.user(userID))
+}